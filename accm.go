@@ -0,0 +1,34 @@
+package main
+
+/* RFC 1662
+ * 7.1. Async-Control-Character-Map (ACCM)
+ * https://tools.ietf.org/html/rfc1662#section-7.1
+ */
+
+// asyncMap is the set of characters escaped on pppd's async link: the async control character
+// map (ACCM) negotiated by LCP for 0x00-0x1f, extended to every character like pppd's escape
+// option. The flag sequence and control escape are always escaped.
+type asyncMap [8]uint32
+
+// ACCM before LCP has negotiated one: every control character is escaped
+const defaultACCM = 0xffffffff
+
+func newAsyncMap(accm uint32, extra []int) asyncMap {
+	m := asyncMap{accm}
+	m.add(flagSequence)
+	m.add(controlEscape)
+	for _, c := range extra {
+		m.add(byte(c))
+	}
+	return m
+}
+
+func (m *asyncMap) add(c byte) {
+	m[c>>5] |= 1 << (c & 31)
+}
+
+func (m *asyncMap) escapes(c byte) bool {
+	return m[c>>5]&(1<<(c&31)) != 0
+}
+
+var defaultAsyncMap = newAsyncMap(defaultACCM, nil)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestUnescaperReceiveMap(t *testing.T) {
+	// XON and XOFF escaped, as software flow control on a serial line would want
+	m := newAsyncMap(1<<0x11|1<<0x13, nil)
+	frame := []byte{0xff, 0x03, 0x00, 0x21, 0x01, 0x11, 0x13, 0x7e, 0x1f}
+	escaped := appendEscaped(nil, frame, &m)
+	if bytes.IndexByte(escaped, 0x01) < 0 || bytes.IndexByte(escaped, 0x11) >= 0 {
+		t.Fatalf("expected 0x01 unescaped and 0x11 escaped, got %x", escaped)
+	}
+	// XON and XOFF inserted in transit are discarded, other control characters kept
+	noisy := append([]byte{flagSequence, 0x11}, escaped[1:]...)
+	noisy = append(noisy[:5:5], append([]byte{0x13}, noisy[5:]...)...)
+
+	var recorder frameRecorder
+	unescaper := newUnescaper(recorder.frame, recorder.onError)
+	unescaper.receiveMap = &m
+	unescaper.Write(noisy)
+	if len(recorder.errs) != 0 || len(recorder.frames) != 1 || !bytes.Equal(recorder.frames[0], frame) {
+		t.Fatalf("expected %x, got %x, errors %v", frame, recorder.frames, recorder.errs)
+	}
+}
+
+// Escaping random data with every control character escaped, as before LCP negotiates, and
+// with the ACCM of 0 clients usually ask for
+func BenchmarkEscapeACCM(b *testing.B) {
+	data := make([]byte, 1400)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, bench := range []struct {
+		name string
+		m    asyncMap
+	}{{"default", defaultAsyncMap}, {"accm0", newAsyncMap(0, nil)}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			buf := getFrameBuffer()
+			defer releaseFrameBuffer(buf)
+			var escaped []byte
+			for n := 0; n < b.N; n++ {
+				escaped = appendEscaped(buf[:0], data, &bench.m)
+			}
+			b.ReportMetric(float64(len(escaped)), "escaped-bytes/op")
+		})
+	}
+}
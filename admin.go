@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Admin interface, a small JSON API for the ban list and sessions:
+ *
+ *   GET    /bans                             list current bans
+ *   PUT    /bans/{address}?duration=&reason= ban an address (duration defaults to bans.duration)
+ *   DELETE /bans/{address}                   lift a ban
+ *   GET    /sessions                         list established sessions
+ *   PUT    /sessions/{id}/limits?upstream_kbps=&downstream_kbps=&session_quota_mb=&period_quota_mb=
+ *                                            replace a session's limits, e.g. from RADIUS attributes
+ *   DELETE /sessions/{id}                    disconnect a session
+ *   PUT    /sessions/{id}/capture?max_bytes=&max_duration=
+ *                                            capture a session to capture.dir (limits default to capture.*)
+ *   DELETE /sessions/{id}/capture            stop capturing a session
+ */
+
+// adminSession describes a session in the admin interface
+type adminSession struct {
+	ID     string        `json:"id"`
+	Remote string        `json:"remote"`
+	User   string        `json:"user"`
+	Bytes  int64         `json:"bytes"`
+	Limits shapingLimits `json:"limits"`
+	// Capture is the file the session is being captured to, if it is
+	Capture string `json:"capture,omitempty"`
+}
+
+func newAdminHandler(srv *server) http.Handler {
+	bans := srv.bans
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, bans.list(time.Now()))
+	})
+	mux.HandleFunc("/bans/", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/bans/"))
+		if ip == nil {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		switch r.Method {
+		case http.MethodPut:
+			duration := bans.cfg.Duration
+			if value := r.URL.Query().Get("duration"); value != "" {
+				var err error
+				duration, err = time.ParseDuration(value)
+				if err != nil || duration <= 0 {
+					http.Error(w, "invalid duration", http.StatusBadRequest)
+					return
+				}
+			}
+			reason := r.URL.Query().Get("reason")
+			if reason == "" {
+				reason = "admin"
+			}
+			entry := ban{ip.String(), now.Add(duration), reason}
+			bans.add(entry, now)
+			writeJSON(w, http.StatusOK, entry)
+		case http.MethodDelete:
+			if !bans.remove(ip.String(), now) {
+				http.Error(w, "not banned", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sessions := make([]adminSession, 0)
+		for _, s := range srv.sessions() {
+			sessions = append(sessions, s.describe())
+		}
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+		writeJSON(w, http.StatusOK, sessions)
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+		var s *session
+		for _, candidate := range srv.sessions() {
+			if candidate.id == id {
+				s = candidate
+			}
+		}
+		if s == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		switch {
+		case action == "limits" && r.Method == http.MethodPut:
+			var limits shapingLimits
+			for name, field := range map[string]*int{
+				"upstream_kbps":    &limits.UpstreamKbps,
+				"downstream_kbps":  &limits.DownstreamKbps,
+				"session_quota_mb": &limits.SessionQuotaMB,
+				"period_quota_mb":  &limits.PeriodQuotaMB,
+			} {
+				if value := r.URL.Query().Get(name); value != "" {
+					n, err := strconv.Atoi(value)
+					if err != nil || n < 0 {
+						http.Error(w, "invalid "+name, http.StatusBadRequest)
+						return
+					}
+					*field = n
+				}
+			}
+			s.setLimits(limits, true)
+			writeJSON(w, http.StatusOK, s.describe())
+		case action == "capture" && r.Method == http.MethodPut:
+			limits := srv.config.Capture.limits()
+			if value := r.URL.Query().Get("max_bytes"); value != "" {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || n < 0 {
+					http.Error(w, "invalid max_bytes", http.StatusBadRequest)
+					return
+				}
+				limits.MaxBytes = n
+			}
+			if value := r.URL.Query().Get("max_duration"); value != "" {
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration < 0 {
+					http.Error(w, "invalid max_duration", http.StatusBadRequest)
+					return
+				}
+				limits.MaxDuration = duration
+			}
+			if _, err := s.startCapture(limits); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			writeJSON(w, http.StatusOK, s.describe())
+		case action == "capture" && r.Method == http.MethodDelete:
+			c := s.capture.Load()
+			if c == nil {
+				http.Error(w, "not capturing", http.StatusNotFound)
+				return
+			}
+			s.stopCapture(c, errCaptureStopped)
+			w.WriteHeader(http.StatusNoContent)
+		case action == "" && r.Method == http.MethodDelete:
+			s.requestDisconnect(disconnectAdmin)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	return mux
+}
+
+func (s *session) describe() adminSession {
+	s.shaping.mu.Lock()
+	defer s.shaping.mu.Unlock()
+	description := adminSession{s.id, s.conn.RemoteAddr().String(), s.username, s.shaping.bytes, s.shaping.limits, ""}
+	if c := s.capture.Load(); c != nil {
+		description.Capture = c.path
+	}
+	return description
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// serveAdmin exposes the admin interface on addr. It has no authentication, so addr should be local.
+func serveAdmin(addr string, srv *server) {
+	slog.Info("Serving admin interface", "addr", addr)
+	slog.Error("admin listener stopped", "err", http.ListenAndServe(addr, newAdminHandler(srv)))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons a client failure counts towards a ban
+const (
+	failureAuth          = "auth"
+	failureCryptoBinding = "crypto_binding"
+	failureMalformed     = "malformed"
+)
+
+type ban struct {
+	Address string    `json:"address"`
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+}
+
+type failureCount struct {
+	count int
+	since time.Time
+}
+
+// banList bans addresses which fail too often, such as by repeatedly failing PPP authentication
+type banList struct {
+	cfg bansConfig
+
+	mu       sync.Mutex
+	bans     map[string]ban
+	failures map[string]*failureCount
+}
+
+// newBanList creates a ban list, loading bans saved by a previous run
+func newBanList(cfg bansConfig) (*banList, error) {
+	b := &banList{
+		cfg:      cfg,
+		bans:     make(map[string]ban),
+		failures: make(map[string]*failureCount),
+	}
+	if cfg.File == "" {
+		return b, nil
+	}
+	contents, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return b, err
+	}
+	var saved []ban
+	if err := json.Unmarshal(contents, &saved); err != nil {
+		return b, err
+	}
+	now := time.Now()
+	for _, entry := range saved {
+		if entry.Until.After(now) {
+			b.bans[entry.Address] = entry
+		}
+	}
+	return b, nil
+}
+
+// isBanned reports whether address is currently banned, forgetting its ban once it has expired
+func (b *banList) isBanned(address string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.bans[address]
+	if ok && !entry.Until.After(now) {
+		delete(b.bans, address)
+		return false
+	}
+	return ok
+}
+
+// recordFailure counts a failure by address, banning it once it reaches the threshold within the window
+func (b *banList) recordFailure(address string, reason string, now time.Time) {
+	if b.cfg.Threshold <= 0 || address == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failures, ok := b.failures[address]
+	if !ok || now.Sub(failures.since) > b.cfg.Window {
+		failures = &failureCount{since: now}
+		b.failures[address] = failures
+		b.forgetOldFailures(now)
+	}
+	failures.count++
+	if failures.count < b.cfg.Threshold {
+		return
+	}
+
+	delete(b.failures, address)
+	// Addresses which never come back would otherwise keep their expired bans
+	b.forgetExpiredBans(now)
+	b.bans[address] = ban{address, now.Add(b.cfg.Duration), reason}
+	metricBans.With(reason).Inc()
+	slog.Warn("Banning address", "address", address, "reason", reason, "failures", failures.count, "duration", b.cfg.Duration)
+	b.saveLocked(now)
+}
+
+func (b *banList) forgetExpiredBans(now time.Time) {
+	for address, entry := range b.bans {
+		if !entry.Until.After(now) {
+			delete(b.bans, address)
+		}
+	}
+}
+
+func (b *banList) forgetOldFailures(now time.Time) {
+	for address, failures := range b.failures {
+		if now.Sub(failures.since) > b.cfg.Window {
+			delete(b.failures, address)
+		}
+	}
+}
+
+// add bans address until the given time, replacing any existing ban
+func (b *banList) add(entry ban, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forgetExpiredBans(now)
+	b.bans[entry.Address] = entry
+	slog.Info("Address banned", "address", entry.Address, "until", entry.Until, "reason", entry.Reason)
+	b.saveLocked(now)
+}
+
+// remove lifts a ban, reporting whether the address was banned
+func (b *banList) remove(address string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, address)
+	entry, ok := b.bans[address]
+	if !ok || !entry.Until.After(now) {
+		return false
+	}
+	delete(b.bans, address)
+	slog.Info("Ban lifted", "address", address)
+	b.saveLocked(now)
+	return true
+}
+
+// list returns the current bans, ordered by address
+func (b *banList) list(now time.Time) []ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.activeLocked(now)
+}
+
+func (b *banList) activeLocked(now time.Time) []ban {
+	b.forgetExpiredBans(now)
+	bans := make([]ban, 0, len(b.bans))
+	for _, entry := range b.bans {
+		bans = append(bans, entry)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Address < bans[j].Address })
+	return bans
+}
+
+// saveLocked writes the current bans to the configured file, replacing it atomically
+func (b *banList) saveLocked(now time.Time) {
+	if b.cfg.File == "" {
+		return
+	}
+	contents, err := json.MarshalIndent(b.activeLocked(now), "", "\t")
+	if err != nil {
+		slog.Error("Failed to encode bans", "err", err)
+		return
+	}
+	temp, err := os.CreateTemp(filepath.Dir(b.cfg.File), ".bans-*")
+	if err == nil {
+		_, err = temp.Write(append(contents, '\n'))
+		if closeErr := temp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(temp.Name(), b.cfg.File)
+		}
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to save bans", "file", b.cfg.File, "err", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", now) {
+			t.Fatalf("burst connection %d refused", i)
+		}
+	}
+	if l.allow("a", now) {
+		t.Fatal("connection beyond burst allowed")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("other key limited")
+	}
+	if !l.allow("a", now.Add(time.Second)) || l.allow("a", now.Add(time.Second)) {
+		t.Fatal("expected one token after a second at 60 per minute")
+	}
+	if !newRateLimiter(0, 0).allow("a", now) {
+		t.Fatal("disabled limiter refused a connection")
+	}
+
+	for ip, prefix := range map[string]string{
+		"192.0.2.77":           "192.0.2.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+	} {
+		if got := addressPrefix(net.ParseIP(ip)); got != prefix {
+			t.Errorf("prefix of %s: expected %s, got %s", ip, prefix, got)
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	cfg := bansConfig{Threshold: 3, Window: time.Minute, Duration: time.Hour, File: file}
+	bans, err := newBanList(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// Failures outside the window don't add up
+	bans.recordFailure("192.0.2.1", failureAuth, now)
+	bans.recordFailure("192.0.2.1", failureAuth, now.Add(2*time.Minute))
+	bans.recordFailure("192.0.2.1", failureAuth, now.Add(2*time.Minute))
+	if bans.isBanned("192.0.2.1", now.Add(2*time.Minute)) {
+		t.Fatal("banned below threshold")
+	}
+	bans.recordFailure("192.0.2.1", failureMalformed, now.Add(2*time.Minute))
+	if !bans.isBanned("192.0.2.1", now.Add(2*time.Minute)) {
+		t.Fatal("not banned at threshold")
+	}
+	if bans.isBanned("192.0.2.1", now.Add(2*time.Hour)) {
+		t.Fatal("ban did not expire")
+	}
+
+	// Bans are reloaded after a restart
+	reloaded, err := newBanList(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reloaded.list(now)
+	if len(list) != 1 || list[0].Address != "192.0.2.1" || list[0].Reason != failureMalformed {
+		t.Fatalf("unexpected bans after reload: %+v", list)
+	}
+	if !reloaded.remove("192.0.2.1", now) {
+		t.Fatal("ban not removed")
+	}
+	reloaded, _ = newBanList(cfg)
+	if len(reloaded.list(now)) != 0 {
+		t.Fatal("removed ban was reloaded")
+	}
+}
+
+// A stream of addresses which offend once and never return doesn't grow the list without bound
+func TestBanListForgetsExpiredBans(t *testing.T) {
+	bans, _ := newBanList(bansConfig{Threshold: 1, Window: time.Minute, Duration: time.Minute})
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		bans.recordFailure(fmt.Sprintf("192.0.2.%d", i), failureAuth, now)
+	}
+	bans.recordFailure("198.51.100.1", failureAuth, now.Add(2*time.Minute))
+	bans.mu.Lock()
+	remaining := len(bans.bans)
+	bans.mu.Unlock()
+	if remaining != 1 {
+		t.Fatalf("expected only the current ban, got %d", remaining)
+	}
+
+	// An expired ban is forgotten when it is looked up
+	if bans.isBanned("198.51.100.1", now.Add(4*time.Minute)) {
+		t.Fatal("ban did not expire")
+	}
+	if _, ok := bans.bans["198.51.100.1"]; ok {
+		t.Fatal("expired ban kept after lookup")
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	srv := newServer(defaultConfig())
+	bans := srv.bans
+	admin := httptest.NewServer(newAdminHandler(srv))
+	defer admin.Close()
+
+	do := func(method string, path string) *http.Response {
+		request, _ := http.NewRequest(method, admin.URL+path, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if response := do(http.MethodPut, "/bans/203.0.113.9?duration=10m&reason=test"); response.StatusCode != http.StatusOK {
+		t.Fatalf("ban returned %s", response.Status)
+	}
+	if !bans.isBanned("203.0.113.9", time.Now()) {
+		t.Fatal("address not banned")
+	}
+	if response := do(http.MethodPut, "/bans/not-an-address"); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid address returned %s", response.Status)
+	}
+
+	response := do(http.MethodGet, "/bans")
+	var list []ban
+	if err := json.NewDecoder(response.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Reason != "test" || time.Until(list[0].Until) > 10*time.Minute {
+		t.Fatalf("unexpected ban list %+v", list)
+	}
+
+	if response := do(http.MethodDelete, "/bans/203.0.113.9"); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("unban returned %s", response.Status)
+	}
+	if response := do(http.MethodDelete, "/bans/203.0.113.9"); response.StatusCode != http.StatusNotFound {
+		t.Fatalf("second unban returned %s", response.Status)
+	}
+}
+
+func TestBanAfterFailures(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Bans.Threshold = 2
+	addr := startTestServer(t, cfg)
+
+	for i := 0; i < 2; i++ {
+		conn := dialTest(t, addr)
+		io.WriteString(conn, "GARBAGE\r\n\r\n")
+		io.ReadAll(conn)
+	}
+	// Banned connections are closed without a response
+	expectClosed(t, dialTest(t, addr))
+}
+
+func TestBanAfterAuthFailure(t *testing.T) {
+	// The fake pppd rejects the client's PAP credentials
+	cfg, pppd := fakePPPD(t, "cat \"$0.nak\"\n"+idlePPPD)
+	nak := pppEscape([]byte{0xff, 0x03, 0xc0, 0x23, 3, 1, 0, 5, 0})
+	if err := os.WriteFile(pppd+".nak", nak, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Bans.Threshold = 1
+	addr := startTestServer(t, cfg)
+
+	conn := dialSSTP(t, addr)
+	conn.Write(connectRequestPacket())
+	expectControl(t, conn, MessageTypeCallConnectAck)
+	for {
+		isControl, _ := readTestPacket(t, conn)
+		if !isControl {
+			break
+		}
+	}
+	conn = dialTest(t, addr)
+	expectClosed(t, conn)
+}
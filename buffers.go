@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// Length of the SSTP header in front of a data packet's PPP frame
+const sstpHeaderLength = 4
+
+// frameBufferSize holds the largest SSTP packet, or the largest frame from pppd after escaping
+// (every byte and the FCS escaped, between two flags) with room for an SSTP header in front
+const frameBufferSize = max(1<<12, sstpHeaderLength+2*(maxFrameSize+2)+2)
+
+// frameBuffer is pooled storage for a frame on its way through a session, so forwarding
+// doesn't allocate. A buffer belongs to whichever goroutine holds it until it is released.
+type frameBuffer [frameBufferSize]byte
+
+var framePool = sync.Pool{New: func() interface{} { return new(frameBuffer) }}
+
+func getFrameBuffer() *frameBuffer {
+	return framePool.Get().(*frameBuffer)
+}
+
+func releaseFrameBuffer(buf *frameBuffer) {
+	if buf != nil {
+		framePool.Put(buf)
+	}
+}
+
+// pooledFrame is a frame or packet in data, backed by buf unless it was too big for the pool
+type pooledFrame struct {
+	buf  *frameBuffer
+	data []byte
+}
+
+// newPooledFrame returns an n byte frame, from the pool if it fits
+func newPooledFrame(n int) pooledFrame {
+	if n > frameBufferSize {
+		return pooledFrame{nil, make([]byte, n)}
+	}
+	buf := getFrameBuffer()
+	return pooledFrame{buf, buf[:n]}
+}
+
+func (f pooledFrame) release() {
+	releaseFrameBuffer(f.buf)
+}
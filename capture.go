@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* PCAP Next Generation (pcapng) Capture File Format
+ * https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-03.html
+ * Link types: https://www.tcpdump.org/linktypes.html
+ */
+
+const (
+	pcapngSectionHeader       = 0x0a0d0d0a
+	pcapngInterfaceDesc       = 0x00000001
+	pcapngEnhancedPacket      = 0x00000006
+	pcapngByteOrderMagic      = 0x1a2b3c4d
+	pcapngOptionEnd           = 0
+	pcapngOptionShbUserAppl   = 4
+	pcapngOptionIfName        = 2
+	pcapngOptionIfDescription = 3
+	pcapngOptionEpbFlags      = 2
+	pcapngFlagInbound         = 1
+	pcapngFlagOutbound        = 2
+
+	linkTypePPP   = 9   // frames with or without address and control fields
+	linkTypeRaw   = 101 // IPv4 or IPv6 packets
+	linkTypeUser0 = 147 // SSTP control messages, for Wireshark's DLT_USER table
+)
+
+// Capture interfaces, in the order they are described in the file
+const (
+	captureControl = iota
+	capturePPP
+	captureIP
+)
+
+var captureInterfaces = []struct {
+	linkType    uint16
+	name        string
+	description string
+}{
+	captureControl: {linkTypeUser0, "sstp", "SSTP control messages"},
+	capturePPP:     {linkTypePPP, "ppp", "PPP frames"},
+	captureIP:      {linkTypeRaw, "ip", "IP packets inside PPP"},
+}
+
+var (
+	errCaptureLimit   = errors.New("capture limit reached")
+	errCaptureStopped = errors.New("stopped through the admin interface")
+	errSessionEnded   = errors.New("session ended")
+)
+
+// captureLimits bounds a capture; zero values are unlimited
+type captureLimits struct {
+	MaxBytes    int64
+	MaxDuration time.Duration
+}
+
+// sessionCapture writes a session's traffic to a pcapng file, until it is stopped or reaches its
+// limits. Packets are written straight through, so the file can be opened while it grows.
+type sessionCapture struct {
+	path     string
+	maxBytes int64
+	deadline time.Time // zero if there is no time limit
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     []byte
+	written int64
+}
+
+// newSessionCapture creates a capture file for a session in dir, named after the session and
+// the time, and writes its section header and interface descriptions
+func newSessionCapture(dir, sessionID string, limits captureLimits, now time.Time) (*sessionCapture, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.pcapng", sessionID, now.UTC().Format("20060102T150405Z")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &sessionCapture{path: path, maxBytes: limits.MaxBytes, file: file}
+	if limits.MaxDuration > 0 {
+		c.deadline = now.Add(limits.MaxDuration)
+	}
+
+	var header []byte
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // version 1.0
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0)) // section length not given
+	body = appendPcapngOption(body, pcapngOptionShbUserAppl, []byte("sstp-go"))
+	body = appendPcapngOption(body, pcapngOptionEnd, nil)
+	header = appendPcapngBlock(header, pcapngSectionHeader, body)
+	for _, iface := range captureInterfaces {
+		body = binary.LittleEndian.AppendUint16(body[:0], iface.linkType)
+		body = binary.LittleEndian.AppendUint16(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, 0) // no snapshot length
+		body = appendPcapngOption(body, pcapngOptionIfName, []byte(iface.name))
+		body = appendPcapngOption(body, pcapngOptionIfDescription, []byte(iface.description))
+		body = appendPcapngOption(body, pcapngOptionEnd, nil)
+		header = appendPcapngBlock(header, pcapngInterfaceDesc, body)
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	c.written = int64(len(header))
+	return c, nil
+}
+
+// appendPcapngOption appends an option, padded to 32 bits
+func appendPcapngOption(out []byte, code uint16, value []byte) []byte {
+	out = binary.LittleEndian.AppendUint16(out, code)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(value)))
+	out = append(out, value...)
+	return appendPadding(out, len(value))
+}
+
+// appendPcapngBlock appends a block with a body which is already padded
+func appendPcapngBlock(out []byte, blockType uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	out = binary.LittleEndian.AppendUint32(out, blockType)
+	out = binary.LittleEndian.AppendUint32(out, length)
+	out = append(out, body...)
+	return binary.LittleEndian.AppendUint32(out, length)
+}
+
+func appendPadding(out []byte, n int) []byte {
+	for ; n%4 != 0; n++ {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// write adds a packet on one of the capture's interfaces as an Enhanced Packet Block, inbound
+// meaning from the client. It returns errCaptureLimit, without writing, once the capture is
+// over its limits.
+func (c *sessionCapture) write(iface int, inbound bool, data []byte, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return os.ErrClosed
+	}
+	length := 12 + 20 + (len(data)+3)&^3 + 12 // block header, fields, data, flags and end options
+	if !c.deadline.IsZero() && now.After(c.deadline) || c.maxBytes > 0 && c.written+int64(length) > c.maxBytes {
+		return errCaptureLimit
+	}
+
+	microseconds := uint64(now.UnixMicro())
+	flags := uint32(pcapngFlagOutbound)
+	if inbound {
+		flags = pcapngFlagInbound
+	}
+	b := binary.LittleEndian.AppendUint32(c.buf[:0], pcapngEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	b = binary.LittleEndian.AppendUint32(b, uint32(iface))
+	b = binary.LittleEndian.AppendUint32(b, uint32(microseconds>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(microseconds))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = appendPadding(append(b, data...), len(data))
+	var flagBytes [4]byte
+	binary.LittleEndian.PutUint32(flagBytes[:], flags)
+	b = appendPcapngOption(b, pcapngOptionEpbFlags, flagBytes[:])
+	b = appendPcapngOption(b, pcapngOptionEnd, nil)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	c.buf = b
+	if _, err := c.file.Write(b); err != nil {
+		return err
+	}
+	c.written += int64(length)
+	return nil
+}
+
+func (c *sessionCapture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// startCapture starts capturing the session's traffic to a file in capture.dir, unless it
+// already is
+func (s *session) startCapture(limits captureLimits) (*sessionCapture, error) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if c := s.capture.Load(); c != nil {
+		return c, nil
+	}
+	dir := s.server.config.Capture.Dir
+	if dir == "" {
+		return nil, errors.New("capture.dir is not set")
+	}
+	c, err := newSessionCapture(dir, s.id, limits, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.capture.Store(c)
+	s.log().Info("Capture started", "file", c.path)
+	return c, nil
+}
+
+// stopCapture stops the session's capture, if c is still the one running, logging why
+func (s *session) stopCapture(c *sessionCapture, reason error) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if c == nil || !s.capture.CompareAndSwap(c, nil) {
+		return
+	}
+	if err := c.close(); err != nil {
+		s.log().Warn("failed to close capture", "file", c.path, "err", err)
+	}
+	s.log().Info("Capture stopped", "file", c.path, "reason", reason)
+}
+
+// capturePacket adds a packet to the session's capture, if one is running
+func (s *session) capturePacket(iface int, inbound bool, data []byte) {
+	c := s.capture.Load()
+	if c == nil {
+		return
+	}
+	if err := c.write(iface, inbound, data, time.Now()); err != nil {
+		s.stopCapture(c, err)
+	}
+}
+
+// captureReceivedControl adds a control message from the client to the session's capture, with
+// the SSTP header the reader took off
+func (s *session) captureReceivedControl(body []byte) {
+	if s.capture.Load() == nil {
+		return
+	}
+	packet := append([]byte{0x10, 0x01, 0, 0}, body...)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	s.capturePacket(captureControl, true, packet)
+}
+
+// captureFrame adds a PPP frame to the session's capture, and the packet inside it to the IP
+// interface
+func (s *session) captureFrame(inbound bool, frame []byte) {
+	if s.capture.Load() == nil {
+		return
+	}
+	s.capturePacket(capturePPP, inbound, frame)
+	if protocol, packet, ok := pppHeader(frame); ok && (protocol == pppProtocolIPv4 || protocol == pppProtocolIPv6) {
+		s.capturePacket(captureIP, inbound, packet)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type capturedPacket struct {
+	iface   int
+	inbound bool
+	data    []byte
+}
+
+// readPcapng returns the link types of a capture's interfaces and its packets
+func readPcapng(t *testing.T, path string) ([]uint16, []capturedPacket) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var linkTypes []uint16
+	var packets []capturedPacket
+	for len(contents) > 0 {
+		if len(contents) < 12 {
+			t.Fatalf("truncated block: %x", contents)
+		}
+		blockType := binary.LittleEndian.Uint32(contents)
+		length := int(binary.LittleEndian.Uint32(contents[4:]))
+		if length%4 != 0 || length > len(contents) || binary.LittleEndian.Uint32(contents[length-4:]) != uint32(length) {
+			t.Fatalf("bad block length %d", length)
+		}
+		body := contents[8 : length-4]
+		switch blockType {
+		case pcapngSectionHeader:
+			if binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				t.Fatal("bad byte order magic")
+			}
+		case pcapngInterfaceDesc:
+			linkTypes = append(linkTypes, binary.LittleEndian.Uint16(body))
+		case pcapngEnhancedPacket:
+			capturedLength := int(binary.LittleEndian.Uint32(body[12:]))
+			options := body[20+(capturedLength+3)&^3:]
+			if binary.LittleEndian.Uint16(options) != pcapngOptionEpbFlags {
+				t.Fatalf("expected flags, got options %x", options)
+			}
+			packets = append(packets, capturedPacket{
+				iface:   int(binary.LittleEndian.Uint32(body)),
+				inbound: binary.LittleEndian.Uint32(options[4:])&3 == pcapngFlagInbound,
+				data:    body[20 : 20+capturedLength],
+			})
+		default:
+			t.Fatalf("unexpected block type %#x", blockType)
+		}
+		contents = contents[length:]
+	}
+	return linkTypes, packets
+}
+
+func TestAdminCapture(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Capture.Dir = t.TempDir()
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+	admin := httptest.NewServer(newAdminHandler(srv))
+	defer admin.Close()
+	s := srv.sessions()[0]
+
+	request, _ := http.NewRequest(http.MethodPut, admin.URL+"/sessions/"+s.id+"/capture?max_duration=1m", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var described adminSession
+	json.NewDecoder(response.Body).Decode(&described)
+	if response.StatusCode != http.StatusOK || described.Capture == "" {
+		t.Fatalf("capture not started: %d %+v", response.StatusCode, described)
+	}
+
+	echo := controlPacket(MessageTypeEchoRequest)
+	client.Write(echo)
+	expectControl(t, client, MessageTypeEchoResponse)
+	ipPacket := append([]byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0}, 10, 0, 0, 1, 10, 0, 0, 2)
+	frame := append([]byte{0xff, 0x03, 0x00, 0x21}, ipPacket...)
+	packetHandler{s}.Write(frame)
+	readTestPacket(t, client)
+
+	request, _ = http.NewRequest(http.MethodDelete, admin.URL+"/sessions/"+s.id+"/capture", nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusNoContent {
+		t.Fatalf("stopping the capture failed: %v %v", response, err)
+	}
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 once stopped: %v %v", response, err)
+	}
+
+	linkTypes, packets := readPcapng(t, described.Capture)
+	if len(linkTypes) != 3 || linkTypes[captureControl] != linkTypeUser0 || linkTypes[capturePPP] != linkTypePPP || linkTypes[captureIP] != linkTypeRaw {
+		t.Fatalf("unexpected interfaces %v", linkTypes)
+	}
+	if len(packets) != 4 {
+		t.Fatalf("expected 4 packets, got %+v", packets)
+	}
+	expected := []capturedPacket{
+		{captureControl, true, echo},
+		{captureControl, false, nil}, // the EchoResponse
+		{capturePPP, false, frame},
+		{captureIP, false, ipPacket},
+	}
+	for i, packet := range packets {
+		if packet.iface != expected[i].iface || packet.inbound != expected[i].inbound ||
+			expected[i].data != nil && !bytes.Equal(packet.data, expected[i].data) {
+			t.Errorf("packet %d: expected %+v, got %+v", i, expected[i], packet)
+		}
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	now := time.Now()
+	c, err := newSessionCapture(t.TempDir(), "limits", captureLimits{MaxBytes: 1024, MaxDuration: time.Minute}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err := c.write(capturePPP, true, make([]byte, 100), now.Add(2*time.Minute)); !errors.Is(err, errCaptureLimit) {
+		t.Fatalf("expected the time limit, got %v", err)
+	}
+	for err == nil {
+		err = c.write(capturePPP, true, make([]byte, 100), now)
+	}
+	if !errors.Is(err, errCaptureLimit) {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(c.path); info.Size() > 1024 || info.Size() < 1024-160 {
+		t.Fatalf("expected the capture to stop just short of 1024 bytes, got %d", info.Size())
+	}
+
+	cfg := defaultConfig()
+	cfg.Capture.All = true
+	if err := cfg.validate(); err == nil || !bytes.Contains([]byte(err.Error()), []byte("capture.all:")) {
+		t.Fatalf("expected capture.all to need capture.dir, got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// batchWriter writes batches of SSTP data packets to the client in one go: with writev on
+// plain sockets, or copied into one buffer otherwise, so TLS sends a single record
+type batchWriter struct {
+	conn     net.Conn
+	vectored bool
+	limit    int           // bytes in a batch, beyond the first packet
+	delay    time.Duration // how long to wait for more packets to fill a batch
+	timer    *time.Timer
+
+	batch   []pooledFrame
+	buffers net.Buffers // backing for vec, reused between batches
+	vec     net.Buffers // consumed by WriteTo
+	flat    []byte
+}
+
+func newBatchWriter(conn net.Conn, cfg queuesConfig) *batchWriter {
+	conn = writeConn(conn)
+	w := &batchWriter{conn: conn, limit: cfg.BatchBytes, delay: cfg.Coalesce}
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		w.vectored = true
+	default:
+		w.flat = make([]byte, 0, cfg.BatchBytes+frameBufferSize)
+	}
+	if w.delay > 0 {
+		w.timer = time.NewTimer(w.delay)
+		w.timer.Stop()
+	}
+	return w
+}
+
+// writeConn returns the connection writes to conn end up on, past wrappers which only change
+// how it is read, so writev can be used on the socket underneath
+func writeConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *handshakeConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// collect starts a batch with first and adds packets already queued, waiting up to the
+// coalescing delay for more. Control messages arriving meanwhile are written straight away.
+// It returns a packet which didn't fit, to start the next batch.
+func (w *batchWriter) collect(s *session, first pooledFrame, done <-chan struct{}) (pooledFrame, error) {
+	w.batch = append(w.batch[:0], first)
+	size := len(first.data)
+	var deadline <-chan time.Time
+	if w.timer != nil {
+		w.timer.Reset(w.delay)
+		defer w.timer.Stop()
+		deadline = w.timer.C
+	}
+	for size < w.limit {
+		var packet pooledFrame
+		select {
+		case packet = <-s.downstream.frames:
+		default:
+			if deadline == nil {
+				return pooledFrame{}, nil
+			}
+			select {
+			case packet = <-s.downstream.frames:
+			case control := <-s.control:
+				if _, err := w.conn.Write(control); err != nil {
+					return pooledFrame{}, err
+				}
+				continue
+			case <-deadline:
+				return pooledFrame{}, nil
+			case <-done:
+				return pooledFrame{}, nil
+			}
+		}
+		if size+len(packet.data) > w.limit {
+			return packet, nil
+		}
+		w.batch = append(w.batch, packet)
+		size += len(packet.data)
+	}
+	return pooledFrame{}, nil
+}
+
+// flush writes the batch and releases its packets
+func (w *batchWriter) flush() error {
+	var err error
+	switch {
+	case len(w.batch) == 1:
+		_, err = w.conn.Write(w.batch[0].data)
+	case w.vectored:
+		w.buffers = w.buffers[:0]
+		for _, packet := range w.batch {
+			w.buffers = append(w.buffers, packet.data)
+		}
+		w.vec = w.buffers
+		_, err = w.vec.WriteTo(w.conn)
+	default:
+		w.flat = w.flat[:0]
+		for _, packet := range w.batch {
+			w.flat = append(w.flat, packet.data...)
+		}
+		_, err = w.conn.Write(w.flat)
+	}
+	for i, packet := range w.batch {
+		packet.release()
+		w.batch[i] = pooledFrame{}
+	}
+	w.batch = w.batch[:0]
+	return err
+}
+
+// writeClient sends control messages and queued SSTP data packets to the client until the
+// session ends. Control messages are written before any data queued behind them.
+func (s *session) writeClient(done <-chan struct{}) {
+	w := newBatchWriter(s.conn, s.server.config.Queues)
+	var next pooledFrame // a packet which didn't fit in the last batch
+	for {
+		var control []byte
+		select {
+		case control = <-s.control:
+		default:
+			if next.data == nil {
+				select {
+				case control = <-s.control:
+				case next = <-s.downstream.frames:
+				case <-done:
+					s.flushControl(w.conn)
+					return
+				}
+			}
+		}
+		var err error
+		if control != nil {
+			_, err = w.conn.Write(control)
+		} else {
+			next, err = w.collect(s, next, done)
+			if err == nil {
+				err = w.flush()
+			}
+		}
+		if err != nil {
+			s.fail(fmt.Errorf("writing to client: %w", err))
+			next.release()
+			return
+		}
+	}
+}
+
+// flushControl writes the control messages queued before the session ended, e.g. a
+// CallConnectAck ahead of a CallAbort
+func (s *session) flushControl(conn net.Conn) {
+	for {
+		select {
+		case control := <-s.control:
+			if _, err := conn.Write(control); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// writeControl sends a control packet ahead of queued data. Once the session has ended, and
+// its writer has stopped, it is written straight to the connection, e.g. for a CallAbort.
+func (s *session) writeControl(packet []byte) error {
+	s.capturePacket(captureControl, false, packet)
+	select {
+	case <-s.done:
+	default:
+		select {
+		case s.control <- packet:
+			return nil
+		case <-s.failed:
+			return s.failErr
+		case <-s.done:
+		}
+	}
+	_, err := s.conn.Write(packet)
+	return err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server configuration with a self-signed certificate
+func testTLSConfig(tb testing.TB) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"localhost"}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// loopbackSession runs a session without pppd on a loopback TCP connection, over TLS if
+// tlsConfig is set, and returns the client end once the session answers control messages
+func loopbackSession(tb testing.TB, cfg *config, tlsConfig *tls.Config) (*session, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverConn, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if tlsConfig != nil {
+		serverConn = tls.Server(serverConn, tlsConfig)
+		client = tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	}
+	s := newSession(newServer(cfg), serverConn)
+	go func() {
+		s.run()
+		serverConn.Close()
+	}()
+	tb.Cleanup(func() { client.Close() })
+
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(tb, client, MessageTypeEchoResponse)
+	return s, client
+}
+
+func TestControlPriority(t *testing.T) {
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	s := newSession(newServer(defaultConfig()), serverConn)
+	go s.run()
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, client, MessageTypeEchoResponse)
+
+	// The client isn't reading, so frames from pppd queue up behind the first batch
+	handler := packetHandler{s}
+	for i := 0; i < 40; i++ {
+		handler.Write(make([]byte, 1400))
+	}
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	time.Sleep(10 * time.Millisecond)
+	for data := 0; ; data++ {
+		if isControl, _ := readTestPacket(t, client); isControl {
+			if data >= 20 {
+				t.Fatalf("EchoResponse was written after %d data packets", data)
+			}
+			return
+		}
+	}
+}
+
+func TestBatchedWritesKeepOrder(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Queues.Coalesce = time.Millisecond
+	cfg.Queues.Downstream = 256
+	for name, newSession := range map[string]func() (*session, net.Conn){
+		"writev": func() (*session, net.Conn) { return loopbackSession(t, cfg, nil) },
+		"tls":    func() (*session, net.Conn) { return loopbackSession(t, cfg, testTLSConfig(t)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, client := newSession()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			handler := packetHandler{s}
+			go func() {
+				for i := 0; i < 500; i++ {
+					frame := make([]byte, 100+i)
+					binary.BigEndian.PutUint32(frame, uint32(i))
+					handler.Write(frame)
+				}
+			}()
+			for i := 0; i < 500; i++ {
+				isControl, data := readTestPacket(t, client)
+				if isControl || len(data) != 100+i || binary.BigEndian.Uint32(data) != uint32(i) ||
+					!bytes.Equal(data[4:], make([]byte, len(data)-4)) {
+					t.Fatalf("packet %d out of order or corrupted: %d bytes", i, len(data))
+				}
+			}
+		})
+	}
+}
+
+func benchmarkClientWrites(b *testing.B, tlsConfig *tls.Config, batchBytes int) {
+	cfg := defaultConfig()
+	cfg.Queues.BatchBytes = batchBytes
+	s, client := loopbackSession(b, cfg, tlsConfig)
+	frame := make([]byte, 100)
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.Discard, client, int64(b.N*(sstpHeaderLength+len(frame))))
+		received <- err
+	}()
+	handler := packetHandler{s}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.Write(frame)
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+// Small packets from pppd to a client over loopback, written one by one as before batching,
+// and batched with writev for TCP or into one record for TLS
+func BenchmarkClientWrites(b *testing.B) {
+	for _, transport := range []struct {
+		name      string
+		tlsConfig *tls.Config
+	}{{"tcp", nil}, {"tls", testTLSConfig(b)}} {
+		b.Run(transport.name+"/unbatched", func(b *testing.B) { benchmarkClientWrites(b, transport.tlsConfig, 0) })
+		b.Run(transport.name+"/batched", func(b *testing.B) { benchmarkClientWrites(b, transport.tlsConfig, 16<<10) })
+	}
+}
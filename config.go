@@ -0,0 +1,620 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type config struct {
+	Server    serverConfig     `toml:"server"`
+	Listeners []listenerConfig `toml:"listener"`
+	PPP       pppConfig        `toml:"ppp"`
+	Timeouts  timeoutsConfig   `toml:"timeouts"`
+	Limits    limitsConfig     `toml:"limits"`
+	Bans      bansConfig       `toml:"bans"`
+	Shaping   shapingConfig    `toml:"shaping"`
+	Queues    queuesConfig     `toml:"queues"`
+	Admin     adminConfig      `toml:"admin"`
+	Capture   captureConfig    `toml:"capture"`
+	Decoy     decoyConfig      `toml:"decoy"`
+	Log       logConfig        `toml:"log"`
+	Metrics   metricsConfig    `toml:"metrics"`
+	Debug     debugConfig      `toml:"debug"`
+}
+
+type serverConfig struct {
+	// Path is the URI clients send SSTP_DUPLEX_POST to
+	Path string `toml:"path"`
+}
+
+type listenerConfig struct {
+	// Network is tcp (IPv4 and IPv6), tcp4, tcp6, unix or systemd
+	Network string `toml:"network"`
+	// Address is host:port for TCP, or the socket path for unix
+	Address string `toml:"address"`
+	// Name selects sockets passed by systemd by their FileDescriptorName; if empty, all remaining sockets are used
+	Name string `toml:"name"`
+	// SocketMode sets the permissions of a unix socket, e.g. 0o660
+	SocketMode uint32    `toml:"socket_mode"`
+	TLS        tlsConfig `toml:"tls"`
+	// ProxyProtocol expects a PROXY protocol v1 or v2 header from sources in ProxyTrusted, which
+	// must be set except on unix sockets, so clients can't claim any address they like
+	ProxyProtocol bool     `toml:"proxy_protocol"`
+	ProxyTrusted  []string `toml:"proxy_trusted"`
+	// ForwardedTrusted are reverse proxies whose Forwarded or X-Forwarded-For headers give the client address
+	ForwardedTrusted []string `toml:"forwarded_trusted"`
+	// CertHashes are hex SHA-1 or SHA-256 hashes of the certificate of a TLS terminating proxy,
+	// for crypto binding. CertHashHeader names a header trusted proxies may send the hash in instead.
+	CertHashes     []string `toml:"cert_hashes"`
+	CertHashHeader string   `toml:"cert_hash_header"`
+}
+
+// tlsConfig enables TLS on a listener when both files are set; otherwise it serves plaintext,
+// for use behind a TLS terminating proxy
+type tlsConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+type pppConfig struct {
+	Pppd        string   `toml:"pppd"`
+	OptionsFile string   `toml:"options_file"`
+	Speed       int      `toml:"speed"` // pppd requires a baud rate even though there is no serial line
+	Args        []string `toml:"args"`
+	// ACCM follows the async control character maps LCP negotiates, instead of escaping every
+	// control character on pppd's pty
+	ACCM bool `toml:"accm"`
+	// Escape lists extra characters to always escape to pppd, like pppd's escape option
+	Escape []int `toml:"escape"`
+	// Framing is async, HDLC-like framing on pppd's stdin and stdout, or sync, whole frames on a
+	// pty, which falls back to async where the pty can't be set up
+	Framing string `toml:"framing"`
+	// MRU is the largest PPP information field in either direction. When set, it overrides the
+	// options files, so pppd negotiates no larger an MRU or MTU with the client, and longer frames
+	// are dropped. 0 leaves the MRU to pppd's options.
+	MRU int `toml:"mru"`
+	// ClampMSS lowers the MSS of TCP SYNs in either direction to fit the MRU, for clients which
+	// ignore the path MTU
+	ClampMSS bool `toml:"clamp_mss"`
+	// SessionOptions is a text/template file rendered into extra pppd options for each session,
+	// e.g. to name each session's interface
+	SessionOptions string `toml:"session_options"`
+}
+
+type timeoutsConfig struct {
+	// Handshake limits how long a client may take to send the HTTP request
+	Handshake time.Duration `toml:"handshake"`
+	// FirstMessage limits how long a client may take to send its first SSTP message after the HTTP response
+	FirstMessage time.Duration `toml:"first_message"`
+	// Negotiation limits how long a client may take to connect the call, from the HTTP response
+	// to CallConnected, as MS-SSTP's negotiation timer; 0 is unlimited
+	Negotiation time.Duration `toml:"negotiation"`
+	// Shutdown limits how long to wait for sessions to acknowledge a CallDisconnect when stopping
+	Shutdown time.Duration `toml:"shutdown"`
+	// DisconnectAck is how long a client has to acknowledge a CallDisconnect before the call is
+	// aborted, as MS-SSTP's disconnect acknowledgement timer
+	DisconnectAck time.Duration `toml:"disconnect_ack"`
+	// PPPDStart limits how long pppd may take to send its first LCP packet
+	PPPDStart time.Duration `toml:"pppd_start"`
+	// PPPDStop is how long pppd has to exit after SIGTERM before it is killed
+	PPPDStop time.Duration `toml:"pppd_stop"`
+}
+
+type limitsConfig struct {
+	// MaxHeaderBytes caps the size of an HTTP request line and headers
+	MaxHeaderBytes int `toml:"max_header_bytes"`
+	// MaxPreAuth caps connections which haven't sent CallConnected, i.e. haven't authenticated; 0 is unlimited
+	MaxPreAuth int `toml:"max_pre_auth"`
+	// MaxPerIP caps concurrent connections from one source address; 0 is unlimited.
+	// Behind trusted reverse proxies, the forwarded client address is counted instead.
+	MaxPerIP int `toml:"max_per_ip"`
+	// ConnectionsPerMinute limits new connections from one address, allowing bursts of ConnectionBurst; 0 is unlimited
+	ConnectionsPerMinute int `toml:"connections_per_minute"`
+	ConnectionBurst      int `toml:"connection_burst"`
+	// PrefixConnectionsPerMinute and PrefixConnectionBurst apply to each IPv4 /24 and IPv6 /64
+	PrefixConnectionsPerMinute int `toml:"prefix_connections_per_minute"`
+	PrefixConnectionBurst      int `toml:"prefix_connection_burst"`
+}
+
+// bansConfig bans addresses which fail authentication, crypto binding or send malformed packets
+// Threshold times within Window, for Duration. File keeps bans across restarts.
+type bansConfig struct {
+	Threshold int           `toml:"threshold"` // 0 disables automatic bans
+	Window    time.Duration `toml:"window"`
+	Duration  time.Duration `toml:"duration"`
+	File      string        `toml:"file"`
+}
+
+// shapingConfig limits sessions' bandwidth and data. The defaults apply to every session;
+// once the user is known, their own rule or else their group's replaces them.
+type shapingConfig struct {
+	shapingLimits
+	// Period is how long period quotas last before they are reset
+	Period time.Duration `toml:"period"`
+	Groups []shapingRule `toml:"group"`
+	Users  []shapingRule `toml:"user"`
+}
+
+// queuesConfig bounds the frames waiting to be written in each direction of a session
+type queuesConfig struct {
+	Upstream   int    `toml:"upstream"`   // frames from the client waiting for pppd
+	Downstream int    `toml:"downstream"` // frames from pppd waiting for the client
+	Policy     string `toml:"policy"`     // block or drop when a queue is full
+	// BatchBytes caps the queued data packets written to the client at once; 0 writes them one by one
+	BatchBytes int `toml:"batch_bytes"`
+	// Coalesce is how long to wait for more packets to fill a batch, adding to their latency
+	Coalesce time.Duration `toml:"coalesce"`
+}
+
+type captureConfig struct {
+	// Dir is where per-session pcapng captures are written; captures are unavailable if it is empty
+	Dir string `toml:"dir"`
+	// All captures every session from its start, rather than only those started through the admin interface
+	All bool `toml:"all"`
+	// MaxBytes stops a capture before its file grows beyond it; 0 is unlimited
+	MaxBytes int `toml:"max_bytes"`
+	// MaxDuration stops a capture once it has run this long; 0 is unlimited
+	MaxDuration time.Duration `toml:"max_duration"`
+}
+
+func (c captureConfig) limits() captureLimits {
+	return captureLimits{int64(c.MaxBytes), c.MaxDuration}
+}
+
+type adminConfig struct {
+	// Address serves the admin interface, which has no authentication; disabled if empty
+	Address string `toml:"address"`
+}
+
+// decoyConfig chooses how HTTP requests which aren't SSTP are answered, so the port looks like
+// an ordinary web server. At most one may be set; if none are, they get an error response.
+type decoyConfig struct {
+	Static   string `toml:"static"`   // directory of files to serve
+	Redirect string `toml:"redirect"` // URL to redirect to
+	Proxy    string `toml:"proxy"`    // URL of a web server to reverse proxy to
+}
+
+type logConfig struct {
+	Level string `toml:"level"`
+	JSON  bool   `toml:"json"`
+	Data  bool   `toml:"data"`
+}
+
+type metricsConfig struct {
+	Address string `toml:"address"`
+}
+
+type debugConfig struct {
+	Pprof string `toml:"pprof"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Server:    serverConfig{Path: "/sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/"},
+		Listeners: []listenerConfig{{Address: ":8080"}},
+		PPP: pppConfig{
+			Pppd:        "pppd",
+			OptionsFile: "/etc/ppp/options.sstpd",
+			Speed:       115200,
+			ACCM:        true,
+			Framing:     pppFramingAsync,
+		},
+		Timeouts: timeoutsConfig{
+			Handshake:     30 * time.Second,
+			FirstMessage:  10 * time.Second,
+			Negotiation:   60 * time.Second,
+			Shutdown:      10 * time.Second,
+			DisconnectAck: 5 * time.Second,
+			PPPDStart:     10 * time.Second,
+			PPPDStop:      5 * time.Second,
+		},
+		Limits: limitsConfig{
+			MaxHeaderBytes:        16 << 10,
+			MaxPreAuth:            1024,
+			ConnectionBurst:       10,
+			PrefixConnectionBurst: 100,
+		},
+		Bans: bansConfig{
+			Threshold: 10,
+			Window:    10 * time.Minute,
+			Duration:  time.Hour,
+		},
+		Shaping: shapingConfig{Period: 30 * 24 * time.Hour},
+		Queues:  queuesConfig{Upstream: 64, Downstream: 64, Policy: queuePolicyBlock, BatchBytes: 16 << 10},
+		Capture: captureConfig{MaxBytes: 64 << 20, MaxDuration: time.Hour},
+		Log:     logConfig{Level: "info"},
+		Debug:   debugConfig{Pprof: "localhost:6060"},
+	}
+}
+
+// configOverrides lists the settings that can be given as command-line flags and SSTP_* environment variables
+var configOverrides = []struct {
+	flag   string
+	key    string
+	isBool bool
+	usage  string
+}{
+	{"listen-network", "listener.network", false, "listener type: tcp, tcp4, tcp6, unix or systemd"},
+	{"listen", "listener.address", false, "address to accept SSTP connections on"},
+	{"tls-cert", "listener.tls.cert_file", false, "TLS certificate file (plaintext if unset)"},
+	{"tls-key", "listener.tls.key_file", false, "TLS private key file"},
+	{"proxy-protocol", "listener.proxy_protocol", true, "expect PROXY protocol headers from trusted proxies"},
+	{"proxy-trusted", "listener.proxy_trusted", false, "comma separated CIDRs allowed to send PROXY protocol headers (required with -proxy-protocol on TCP)"},
+	{"forwarded-trusted", "listener.forwarded_trusted", false, "comma separated CIDRs of reverse proxies whose X-Forwarded-For and Forwarded headers are trusted"},
+	{"cert-hash", "listener.cert_hashes", false, "comma separated hex SHA-1 or SHA-256 hashes of a TLS terminating proxy's certificate"},
+	{"path", "server.path", false, "URI clients send SSTP_DUPLEX_POST to"},
+	{"pppd", "ppp.pppd", false, "pppd binary"},
+	{"pppd-options", "ppp.options_file", false, "pppd options file"},
+	{"ppp-framing", "ppp.framing", false, "how frames are passed to pppd: async, or sync on a pty"},
+	{"handshake-timeout", "timeouts.handshake", false, "time allowed for the HTTP handshake"},
+	{"shutdown-timeout", "timeouts.shutdown", false, "time allowed for sessions to disconnect when stopping"},
+	{"max-pre-auth", "limits.max_pre_auth", false, "maximum connections which haven't authenticated (0 is unlimited)"},
+	{"max-per-ip", "limits.max_per_ip", false, "maximum concurrent connections from one address (0 is unlimited)"},
+	{"decoy-static", "decoy.static", false, "directory served to HTTP requests which aren't SSTP"},
+	{"decoy-redirect", "decoy.redirect", false, "URL HTTP requests which aren't SSTP are redirected to"},
+	{"decoy-proxy", "decoy.proxy", false, "URL HTTP requests which aren't SSTP are reverse proxied to"},
+	{"queue-policy", "queues.policy", false, "what a full data queue does with another frame: block or drop"},
+	{"capture-dir", "capture.dir", false, "directory for per-session pcapng captures (disabled if empty)"},
+	{"capture-all", "capture.all", true, "capture every session to capture.dir"},
+	{"ban-file", "bans.file", false, "file to keep bans in across restarts"},
+	{"admin", "admin.address", false, "address to serve the admin interface on, e.g. localhost:9101 (disabled if empty)"},
+	{"log-level", "log.level", false, "log level: debug, info, warn or error"},
+	{"log-json", "log.json", true, "write logs as JSON lines"},
+	{"log-data", "log.data", true, "hex dump data packets as well as control packets at debug level"},
+	{"metrics", "metrics.address", false, "address to serve Prometheus metrics on, e.g. localhost:9100 (disabled if empty)"},
+	{"pprof", "debug.pprof", false, "address to serve pprof on (disabled if empty)"},
+}
+
+// envName is the environment variable that overrides a config key, e.g. log.level is SSTP_LOG_LEVEL
+func envName(key string) string {
+	return "SSTP_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+type overrideFlag struct {
+	isBool bool
+	value  *string
+}
+
+func (f overrideFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f overrideFlag) Set(value string) error {
+	*f.value = value
+	return nil
+}
+
+func (f overrideFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// parseCommandLine builds the configuration from defaults, the config file, environment variables
+// and flags, in increasing order of precedence. checkOnly is set if -check-config was given.
+func parseCommandLine(args []string, getenv func(string) string, output io.Writer) (cfg *config, checkOnly bool, err error) {
+	flags := flag.NewFlagSet("sstp-go", flag.ContinueOnError)
+	flags.SetOutput(output)
+	configPath := flags.String("config", getenv("SSTP_CONFIG"), "configuration file (TOML)")
+	flags.BoolVar(&checkOnly, "check-config", false, "validate the configuration and exit")
+
+	flagValues := make([]*string, len(configOverrides))
+	for i, override := range configOverrides {
+		flagValues[i] = new(string)
+		usage := fmt.Sprintf("%s (%s, env %s)", override.usage, override.key, envName(override.key))
+		flags.Var(overrideFlag{override.isBool, flagValues[i]}, override.flag, usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if flags.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	settings := make(map[string]interface{})
+	if *configPath != "" {
+		contents, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, false, err
+		}
+		settings, err = parseTOML(*configPath, string(contents))
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, override := range configOverrides {
+		if value := getenv(envName(override.key)); value != "" {
+			if err := setConfigKey(settings, override.key, value); err != nil {
+				return nil, false, fmt.Errorf("%s: %v", envName(override.key), err)
+			}
+		}
+	}
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	for i, override := range configOverrides {
+		if setFlags[override.flag] {
+			if err := setConfigKey(settings, override.key, *flagValues[i]); err != nil {
+				return nil, false, fmt.Errorf("-%s: %v", override.flag, err)
+			}
+		}
+	}
+
+	cfg = defaultConfig()
+	if err := decodeTOML(settings, cfg); err != nil {
+		return nil, false, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return cfg, checkOnly, nil
+}
+
+// setConfigKey sets a dotted key in parsed TOML, replacing any value from the config file
+func setConfigKey(settings map[string]interface{}, key string, value string) error {
+	keys := strings.Split(key, ".")
+	table, err := descend(settings, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	table[keys[len(keys)-1]] = value
+	return nil
+}
+
+// validate checks the configuration for errors which would otherwise only show up when a client connects
+func (cfg *config) validate() error {
+	var errs []error
+	addError := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	checkAddress := func(key string, address string) {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			addError("%s: invalid address %q: %v", key, address, err)
+		}
+	}
+
+	if !strings.HasPrefix(cfg.Server.Path, "/") {
+		addError("server.path: must start with /, got %q", cfg.Server.Path)
+	}
+
+	if len(cfg.Listeners) == 0 {
+		addError("listener: at least one listener is required")
+	}
+	for i, l := range cfg.Listeners {
+		key := fmt.Sprintf("listener[%d]", i)
+		switch l.network() {
+		case "tcp", "tcp4", "tcp6":
+			checkAddress(key+".address", l.Address)
+		case networkUnix:
+			if l.Address == "" {
+				addError("%s.address: socket path required", key)
+			}
+		case networkSystemd:
+		default:
+			addError("%s.network: must be tcp, tcp4, tcp6, unix or systemd, got %q", key, l.Network)
+		}
+		if l.Name != "" && l.Network != networkSystemd {
+			addError("%s.name: only used with network = \"systemd\"", key)
+		}
+		if l.SocketMode != 0 && l.Network != networkUnix {
+			addError("%s.socket_mode: only used with network = \"unix\"", key)
+		}
+		if (l.TLS.CertFile == "") != (l.TLS.KeyFile == "") {
+			addError("%s.tls: cert_file and key_file must be set together", key)
+		} else if l.TLS.CertFile != "" {
+			if _, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile); err != nil {
+				addError("%s.tls: %v", key, err)
+			}
+		}
+		if _, err := parseCIDRs(l.ProxyTrusted); err != nil {
+			addError("%s.proxy_trusted: %v", key, err)
+		} else if l.ProxyProtocol && len(l.ProxyTrusted) == 0 && l.Network != "unix" {
+			addError("%s.proxy_trusted: must list the balancers allowed to send PROXY headers", key)
+		}
+		if _, err := parseCIDRs(l.ForwardedTrusted); err != nil {
+			addError("%s.forwarded_trusted: %v", key, err)
+		}
+		for _, value := range l.CertHashes {
+			if _, err := parseCertHash(value); err != nil {
+				addError("%s.cert_hashes: %q: %v", key, value, err)
+			}
+		}
+		if l.CertHashHeader != "" && len(l.ForwardedTrusted) == 0 {
+			addError("%s.cert_hash_header: requires forwarded_trusted", key)
+		}
+	}
+
+	if _, err := exec.LookPath(cfg.PPP.Pppd); err != nil {
+		addError("ppp.pppd: %v", err)
+	}
+	if cfg.PPP.OptionsFile != "" {
+		if _, err := os.Stat(cfg.PPP.OptionsFile); err != nil {
+			addError("ppp.options_file: %v", err)
+		}
+	}
+	if cfg.PPP.Speed < 0 {
+		addError("ppp.speed: must not be negative, got %d", cfg.PPP.Speed)
+	}
+	if cfg.PPP.Framing != pppFramingAsync && cfg.PPP.Framing != pppFramingSync {
+		addError("ppp.framing: must be async or sync, got %q", cfg.PPP.Framing)
+	}
+	if _, err := loadSessionOptions(cfg.PPP.SessionOptions); err != nil {
+		addError("ppp.session_options: %v", err)
+	}
+	if cfg.PPP.MRU != 0 && (cfg.PPP.MRU < minMRU || cfg.PPP.MRU > maxMRU) {
+		addError("ppp.mru: must be 0 or %d-%d, got %d", minMRU, maxMRU, cfg.PPP.MRU)
+	}
+	for _, c := range cfg.PPP.Escape {
+		if c < 0 || c > 0xff {
+			addError("ppp.escape: characters must be 0-255, got %d", c)
+		}
+	}
+
+	if cfg.Timeouts.Handshake < 0 {
+		addError("timeouts.handshake: must not be negative, got %v", cfg.Timeouts.Handshake)
+	}
+	if cfg.Timeouts.FirstMessage < 0 {
+		addError("timeouts.first_message: must not be negative, got %v", cfg.Timeouts.FirstMessage)
+	}
+	if cfg.Timeouts.Negotiation < 0 {
+		addError("timeouts.negotiation: must not be negative, got %v", cfg.Timeouts.Negotiation)
+	}
+	if cfg.Timeouts.Shutdown < 0 {
+		addError("timeouts.shutdown: must not be negative, got %v", cfg.Timeouts.Shutdown)
+	}
+	if cfg.Timeouts.DisconnectAck <= 0 {
+		addError("timeouts.disconnect_ack: must be positive, got %v", cfg.Timeouts.DisconnectAck)
+	}
+	if cfg.Timeouts.PPPDStart < 0 {
+		addError("timeouts.pppd_start: must not be negative, got %v", cfg.Timeouts.PPPDStart)
+	}
+	if cfg.Timeouts.PPPDStop < 0 {
+		addError("timeouts.pppd_stop: must not be negative, got %v", cfg.Timeouts.PPPDStop)
+	}
+
+	if cfg.Limits.MaxHeaderBytes < 1024 {
+		addError("limits.max_header_bytes: must be at least 1024, got %d", cfg.Limits.MaxHeaderBytes)
+	}
+	if cfg.Limits.MaxPreAuth < 0 {
+		addError("limits.max_pre_auth: must not be negative, got %d", cfg.Limits.MaxPreAuth)
+	}
+	if cfg.Limits.MaxPerIP < 0 {
+		addError("limits.max_per_ip: must not be negative, got %d", cfg.Limits.MaxPerIP)
+	}
+
+	for key, value := range map[string]int{
+		"limits.connections_per_minute":        cfg.Limits.ConnectionsPerMinute,
+		"limits.prefix_connections_per_minute": cfg.Limits.PrefixConnectionsPerMinute,
+		"bans.threshold":                       cfg.Bans.Threshold,
+	} {
+		if value < 0 {
+			addError("%s: must not be negative, got %d", key, value)
+		}
+	}
+	if cfg.Limits.ConnectionsPerMinute > 0 && cfg.Limits.ConnectionBurst < 1 {
+		addError("limits.connection_burst: must be at least 1, got %d", cfg.Limits.ConnectionBurst)
+	}
+	if cfg.Limits.PrefixConnectionsPerMinute > 0 && cfg.Limits.PrefixConnectionBurst < 1 {
+		addError("limits.prefix_connection_burst: must be at least 1, got %d", cfg.Limits.PrefixConnectionBurst)
+	}
+	if cfg.Bans.Threshold > 0 && cfg.Bans.Window <= 0 {
+		addError("bans.window: must be positive, got %v", cfg.Bans.Window)
+	}
+	if cfg.Bans.Threshold > 0 && cfg.Bans.Duration <= 0 {
+		addError("bans.duration: must be positive, got %v", cfg.Bans.Duration)
+	}
+	if cfg.Bans.File != "" {
+		if _, err := os.Stat(filepath.Dir(cfg.Bans.File)); err != nil {
+			addError("bans.file: %v", err)
+		}
+	}
+
+	checkLimits := func(key string, limits shapingLimits) {
+		if limits.UpstreamKbps < 0 || limits.DownstreamKbps < 0 || limits.SessionQuotaMB < 0 || limits.PeriodQuotaMB < 0 {
+			addError("%s: limits must not be negative", key)
+		}
+	}
+	checkLimits("shaping", cfg.Shaping.shapingLimits)
+	if cfg.Shaping.Period <= 0 {
+		addError("shaping.period: must be positive, got %v", cfg.Shaping.Period)
+	}
+	for i, group := range cfg.Shaping.Groups {
+		key := fmt.Sprintf("shaping.group[%d]", i)
+		if group.Name == "" || len(group.Users) == 0 {
+			addError("%s: name and users are required", key)
+		}
+		checkLimits(key, group.shapingLimits)
+	}
+	for i, user := range cfg.Shaping.Users {
+		key := fmt.Sprintf("shaping.user[%d]", i)
+		if user.Name == "" {
+			addError("%s: name is required", key)
+		}
+		if len(user.Users) > 0 {
+			addError("%s.users: only used in groups", key)
+		}
+		checkLimits(key, user.shapingLimits)
+	}
+
+	if cfg.Queues.Upstream < 1 {
+		addError("queues.upstream: must be at least 1, got %d", cfg.Queues.Upstream)
+	}
+	if cfg.Queues.Downstream < 1 {
+		addError("queues.downstream: must be at least 1, got %d", cfg.Queues.Downstream)
+	}
+	if cfg.Queues.BatchBytes < 0 {
+		addError("queues.batch_bytes: must not be negative, got %d", cfg.Queues.BatchBytes)
+	}
+	if cfg.Queues.Coalesce < 0 || cfg.Queues.Coalesce > time.Second {
+		addError("queues.coalesce: must be between 0 and 1s, got %v", cfg.Queues.Coalesce)
+	}
+	if cfg.Queues.Policy != queuePolicyBlock && cfg.Queues.Policy != queuePolicyDrop {
+		addError("queues.policy: must be block or drop, got %q", cfg.Queues.Policy)
+	}
+
+	if cfg.Capture.Dir != "" {
+		if info, err := os.Stat(cfg.Capture.Dir); err != nil {
+			addError("capture.dir: %v", err)
+		} else if !info.IsDir() {
+			addError("capture.dir: %s is not a directory", cfg.Capture.Dir)
+		}
+	} else if cfg.Capture.All {
+		addError("capture.all: requires capture.dir")
+	}
+	if cfg.Capture.MaxBytes < 0 {
+		addError("capture.max_bytes: must not be negative, got %d", cfg.Capture.MaxBytes)
+	}
+	if cfg.Capture.MaxDuration < 0 {
+		addError("capture.max_duration: must not be negative, got %v", cfg.Capture.MaxDuration)
+	}
+
+	decoys := 0
+	for _, value := range []string{cfg.Decoy.Static, cfg.Decoy.Redirect, cfg.Decoy.Proxy} {
+		if value != "" {
+			decoys++
+		}
+	}
+	if decoys > 1 {
+		addError("decoy: only one of static, redirect and proxy may be set")
+	}
+	if cfg.Decoy.Static != "" {
+		if info, err := os.Stat(cfg.Decoy.Static); err != nil {
+			addError("decoy.static: %v", err)
+		} else if !info.IsDir() {
+			addError("decoy.static: %s is not a directory", cfg.Decoy.Static)
+		}
+	}
+	for key, value := range map[string]string{"decoy.redirect": cfg.Decoy.Redirect, "decoy.proxy": cfg.Decoy.Proxy} {
+		if value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(value); err != nil {
+			addError("%s: %v", key, err)
+		} else if parsed.Scheme == "" || parsed.Host == "" {
+			addError("%s: %q must be an absolute URL", key, value)
+		}
+	}
+
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		addError("log.level: %v", err)
+	}
+	if cfg.Metrics.Address != "" {
+		checkAddress("metrics.address", cfg.Metrics.Address)
+	}
+	if cfg.Admin.Address != "" {
+		checkAddress("admin.address", cfg.Admin.Address)
+	}
+	if cfg.Debug.Pprof != "" {
+		checkAddress("debug.pprof", cfg.Debug.Pprof)
+	}
+
+	return errors.Join(errs...)
+}
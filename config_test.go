@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	input := `
+# comment
+top = "value # not a comment"
+[a]
+int = 1_000
+hex = 0x1f
+zero = -0
+float = 1.5
+exponent = 1e3
+escaped = "tab\t\"\u00e9\U0001F600"
+bool = true
+literal = 'C:\path'
+list = [
+	"x", # first
+	"y",
+]
+[a.b]
+c = "nested"
+[[arr]]
+n = 1
+[[arr]]
+n = 2
+`
+	parsed, err := parseTOML("test.toml", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"top": "value # not a comment",
+		"a": map[string]interface{}{
+			"int":      int64(1000),
+			"hex":      int64(31),
+			"zero":     int64(0),
+			"float":    1.5,
+			"exponent": 1000.0,
+			"escaped":  "tab\t\"\u00e9\U0001F600",
+			"bool":     true,
+			"literal":  `C:\path`,
+			"list":     []interface{}{"x", "y"},
+			"b":        map[string]interface{}{"c": "nested"},
+		},
+		"arr": []map[string]interface{}{{"n": int64(1)}, {"n": int64(2)}},
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Fatalf("got %#v", parsed)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := map[string]string{
+		"a = 1\na = 2":       "test.toml:2: duplicate key",
+		"[a]\n[a]":           "test.toml:2: table [a] defined more than once",
+		"a = \"unterminated": "test.toml:1: unterminated string",
+		"a = {b = 1}":        "test.toml:1: key \"a\": inline tables",
+		"just words":         "test.toml:1: expected key = value",
+		"a = [1, 2":          "test.toml:1: key \"a\": expected , or ]",
+		// Leading zeros aren't octal, or allowed at all
+		"a = 010":   "test.toml:1: key \"a\": invalid value \"010\"",
+		"a = 01.5":  "test.toml:1: key \"a\": invalid value \"01.5\"",
+		"a = 0X1f":  "test.toml:1: key \"a\": invalid value \"0X1f\"",
+		"a = 1__0":  "test.toml:1: key \"a\": invalid value \"1__0\"",
+		"a = -0x1f": "test.toml:1: key \"a\": invalid value \"-0x1f\"",
+		// Go's escapes aren't TOML's
+		`a = "\x41"`:   `test.toml:1: key "a": invalid string "\x41": invalid escape \x`,
+		`a = "\a"`:     `test.toml:1: key "a": invalid string "\a": invalid escape \a`,
+		`a = "\ud800"`: `test.toml:1: key "a": invalid string "\ud800": invalid escape \ud800`,
+		"a = \"\x00\"": `test.toml:1: key "a": invalid string`,
+	}
+	for input, expected := range tests {
+		_, err := parseTOML("test.toml", input)
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("%q: expected error %q, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sstp-go.toml")
+	err := os.WriteFile(path, []byte(`
+[listener]
+address = ":443"
+[ppp]
+args = ["debug"]
+[log]
+level = "warn"
+json = true
+[timeouts]
+handshake = "5s"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"SSTP_CONFIG":    path,
+		"SSTP_LOG_LEVEL": "error",
+		"SSTP_PPP_PPPD":  "/usr/sbin/pppd",
+	}
+	cfg, checkOnly, err := parseCommandLine([]string{"-check-config", "-log-level", "debug"}, func(key string) string { return env[key] }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkOnly {
+		t.Error("-check-config not set")
+	}
+	if cfg.Listeners[0].Address != ":443" || !cfg.Log.JSON || cfg.Timeouts.Handshake != 5*time.Second {
+		t.Errorf("config file not applied: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.PPP.Args, []string{"debug"}) {
+		t.Errorf("ppp.args = %v", cfg.PPP.Args)
+	}
+	if cfg.PPP.Pppd != "/usr/sbin/pppd" {
+		t.Errorf("environment not applied, ppp.pppd = %q", cfg.PPP.Pppd)
+	}
+	if cfg.Log.Level != "debug" {
+		t.Errorf("flag should override environment and file, log.level = %q", cfg.Log.Level)
+	}
+	if cfg.PPP.OptionsFile != defaultConfig().PPP.OptionsFile {
+		t.Errorf("default lost, ppp.options_file = %q", cfg.PPP.OptionsFile)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sstp-go.toml")
+	os.WriteFile(path, []byte("[log]\nlevle = \"debug\"\n"), 0644)
+	_, _, err := parseCommandLine([]string{"-config", path}, func(string) string { return "" }, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), `unknown key "log.levle"`) {
+		t.Errorf("expected unknown key error, got %v", err)
+	}
+
+	_, _, err = parseCommandLine([]string{"-handshake-timeout", "soon"}, func(string) string { return "" }, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "timeouts.handshake") {
+		t.Errorf("expected duration error, got %v", err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Server.Path = "sra"
+	cfg.Listeners[0].Address = "8080"
+	cfg.Listeners[0].TLS.CertFile = "server.crt"
+	cfg.Listeners[0].ProxyProtocol = true
+	cfg.PPP.Pppd = "/nonexistent/pppd"
+	cfg.PPP.Escape = []int{0x11, 0x100}
+	cfg.PPP.MRU = maxMRU + 1
+	cfg.Decoy.Redirect = "https://www.example.com/"
+	cfg.Decoy.Proxy = "127.0.0.1:8081"
+	cfg.Log.Level = "loud"
+	err = cfg.validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, key := range []string{"server.path", "listener[0].address", "listener[0].tls", "listener[0].proxy_trusted", "ppp.pppd", "ppp.escape", "ppp.mru", "decoy", "decoy.proxy", "log.level"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("expected an error for %s, got:\n%v", key, err)
+		}
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		logDataFrames = false
+	})
+	tests := []struct {
+		level   string
+		json    bool
+		logged  string // of a debug, info, warn and error message, or "" for an invalid level
+		wantErr bool
+	}{
+		{"debug", false, "debug info warn error", false},
+		{"", false, "info warn error", false},
+		{"INFO", true, "info warn error", false},
+		{"warning", false, "warn error", false},
+		{"Warn", true, "warn error", false},
+		{"error", false, "error", false},
+		{"loud", false, "", true},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := setupLogging(&buf, test.level, test.json, true)
+		if (err != nil) != test.wantErr {
+			t.Errorf("level %q: unexpected error %v", test.level, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !logDataFrames {
+			t.Errorf("level %q: data logging not enabled", test.level)
+		}
+		for _, message := range []string{"debug", "info", "warn", "error"} {
+			level, _ := parseLogLevel(message)
+			slog.Log(context.Background(), level, message)
+		}
+		var logged []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if test.json {
+				var record struct{ Msg string }
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("level %q: expected JSON, got %q", test.level, line)
+				}
+				logged = append(logged, record.Msg)
+			} else {
+				if !strings.HasPrefix(line, "time=") {
+					t.Fatalf("level %q: expected text, got %q", test.level, line)
+				}
+				logged = append(logged, line[strings.Index(line, "msg=")+4:])
+			}
+		}
+		if got := strings.Join(logged, " "); got != test.logged {
+			t.Errorf("level %q: expected %q logged, got %q", test.level, test.logged, got)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	_, _, err := parseCommandLine([]string{"-config", "sstp-go.example.toml"}, func(string) string { return "" }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/* Crypto binding, MS-SSTP 3.2.5.2
+ * https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-sstp/
+ *
+ * The client proves it saw our certificate by returning its hash, with the nonce
+ * sent in CallConnectAck. The Compound MAC is keyed with the PPP authentication
+ * keys, which only pppd knows, so it isn't checked here.
+ */
+
+// Hash protocols in the Crypto Binding attributes
+const (
+	certHashProtocolSHA1   = 1
+	certHashProtocolSHA256 = 2
+)
+
+const cryptoBindingNonceLength = 32
+
+// Crypto Binding attribute data: Reserved (3), Hash Protocol (1), Nonce (32), Cert Hash (32), Compound MAC (32)
+const cryptoBindingLength = 100
+
+func newNonce() [cryptoBindingNonceLength]byte {
+	var nonce [cryptoBindingNonceLength]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return nonce
+}
+
+// certificateHashes returns the SHA-1 and SHA-256 hashes of a DER encoded certificate
+func certificateHashes(der []byte) [][]byte {
+	sha1Hash := sha1.Sum(der)
+	sha256Hash := sha256.Sum256(der)
+	return [][]byte{sha1Hash[:], sha256Hash[:]}
+}
+
+// parseCertHash parses a hex SHA-1 or SHA-256 certificate hash, allowing : separators
+func parseCertHash(value string) ([]byte, error) {
+	hash, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(value), ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != sha1.Size && len(hash) != sha256.Size {
+		return nil, fmt.Errorf("certificate hash must be SHA-1 or SHA-256, got %d bytes", len(hash))
+	}
+	return hash, nil
+}
+
+// listenerCertHashes returns the hashes clients should see for a listener: those of its own
+// certificate when it serves TLS, and any configured for a TLS terminating proxy
+func listenerCertHashes(l listenerConfig) ([][]byte, error) {
+	var hashes [][]byte
+	if l.TLS.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, certificateHashes(certificate.Certificate[0])...)
+	}
+	for _, value := range l.CertHashes {
+		hash, err := parseCertHash(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", value, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// verifyCryptoBinding checks the Crypto Binding attribute of a CallConnected message
+func (s *session) verifyCryptoBinding(data []byte) error {
+	if len(data) < cryptoBindingLength {
+		return &abortError{StatusInvalidAttribValueLength, AttributeIDCryptoBinding, errors.New("Crypto Binding attribute too short")}
+	}
+	hashProtocol := data[3]
+	nonce := data[4:36]
+	certHash := data[36:68]
+
+	if !bytes.Equal(nonce, s.nonce[:]) {
+		return &abortError{StatusValueNotSupported, AttributeIDCryptoBinding, errors.New("crypto binding nonce does not match")}
+	}
+
+	var hashLength int
+	switch hashProtocol {
+	case certHashProtocolSHA1:
+		hashLength = sha1.Size
+	case certHashProtocolSHA256:
+		hashLength = sha256.Size
+	default:
+		return &abortError{StatusValueNotSupported, AttributeIDCryptoBinding, fmt.Errorf("unsupported crypto binding hash protocol %d", hashProtocol)}
+	}
+
+	if len(s.certHashes) == 0 {
+		s.log().Debug("No certificate hash known, crypto binding not verified")
+		return nil
+	}
+	for _, expected := range s.certHashes {
+		if len(expected) == hashLength && bytes.Equal(expected, certHash[:hashLength]) {
+			return nil
+		}
+	}
+	return &abortError{StatusValueNotSupported, AttributeIDCryptoBinding, errors.New("crypto binding certificate hash does not match")}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// What a full data queue does with another frame
+const (
+	queuePolicyBlock = "block" // wait for space, pushing back on pppd or the client's TCP window
+	queuePolicyDrop  = "drop"  // discard the frame, leaving PPP's protocols to recover
+)
+
+// packetQueue is a bounded queue of PPP frames for one direction of a session, drained by a
+// single writer goroutine
+type packetQueue struct {
+	direction string // rx (to pppd) or tx (to the client), as in the data metrics
+	frames    chan pooledFrame
+	drop      bool
+}
+
+func newPacketQueue(direction string, length int, policy string) *packetQueue {
+	return &packetQueue{direction, make(chan pooledFrame, length), policy == queuePolicyDrop}
+}
+
+// push queues a frame for s's writer, which releases it. It returns false if the session has
+// failed or ended.
+func (q *packetQueue) push(s *session, frame pooledFrame) bool {
+	if q.drop {
+		select {
+		case <-s.failed:
+		case <-s.done:
+		case q.frames <- frame:
+			return true
+		default:
+			metricDroppedPackets.With(q.direction).Inc()
+			frame.release()
+			return true
+		}
+	} else {
+		select {
+		case q.frames <- frame:
+			return true
+		case <-s.failed:
+		case <-s.done:
+		}
+	}
+	frame.release()
+	return false
+}
+
+// fail ends the session with err, from any goroutine. Only the first failure is kept.
+func (s *session) fail(err error) {
+	s.failOnce.Do(func() {
+		s.failErr = err
+		close(s.failed)
+	})
+}
+
+// pppdExitGrace is how long a failed write to pppd waits for it to exit, which would explain it
+const pppdExitGrace = 2 * time.Second
+
+// writePPPD sends queued frames from the client to pppd's stdin, or its pty in sync mode, until
+// the session ends or stops pppd. Upstream shaping waits here, so it doesn't hold up control
+// messages.
+func (s *session) writePPPD(stdin io.Writer, sync bool, stopping <-chan struct{}, done <-chan struct{}) {
+	for {
+		select {
+		case frame := <-s.upstream.frames:
+			// Nothing more goes through once the session is over its quota
+			if s.shaping.exceeded.Load() {
+				frame.release()
+				continue
+			}
+			if !s.shapeData(len(frame.data), true) {
+				frame.release()
+				return
+			}
+			data := s.toPPPD.compress(frame.data)
+			m := s.toPPPD.snoop(data)
+			if cfg := s.server.config.PPP; cfg.ClampMSS {
+				clampMSS(data, cfg.clampMRU())
+			}
+			s.observeFrame("rx", data)
+			var err error
+			if sync {
+				_, err = stdin.Write(data)
+			} else {
+				escaped := getFrameBuffer()
+				_, err = stdin.Write(appendEscaped(escaped[:0], data, m))
+				releaseFrameBuffer(escaped)
+			}
+			frame.release()
+			if err != nil {
+				// pppd closes its end as it exits, and its exit disconnects the session instead
+				select {
+				case <-stopping:
+				case <-done:
+				case <-s.pppd.exited:
+				case <-time.After(pppdExitGrace):
+					s.fail(&abortError{StatusNoError, 0, fmt.Errorf("writing to pppd: %w", err)})
+				}
+				return
+			}
+		case <-stopping:
+			return
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPacketQueuePolicies(t *testing.T) {
+	conn, _ := net.Pipe()
+	s := newSession(newServer(defaultConfig()), conn)
+	done := make(chan struct{})
+	s.done = done
+
+	dropped := atomic.LoadUint64(&metricDroppedPackets.With("tx").value)
+	queue := newPacketQueue("tx", 2, queuePolicyDrop)
+	for i := 0; i < 3; i++ {
+		if !queue.push(s, newPooledFrame(1)) {
+			t.Fatal("drop queue refused a frame")
+		}
+	}
+	if len(queue.frames) != 2 || atomic.LoadUint64(&metricDroppedPackets.With("tx").value) != dropped+1 {
+		t.Fatalf("expected 2 queued frames and 1 drop, got %d queued", len(queue.frames))
+	}
+
+	queue = newPacketQueue("tx", 1, queuePolicyBlock)
+	queue.push(s, newPooledFrame(1))
+	pushed := make(chan bool)
+	go func() { pushed <- queue.push(s, newPooledFrame(1)) }()
+	select {
+	case <-pushed:
+		t.Fatal("block queue accepted a frame while full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.fail(errors.New("test"))
+	if <-pushed {
+		t.Fatal("blocked push succeeded after the session failed")
+	}
+}
+
+// failDataConn fails writes of SSTP data packets, as if the client had gone away
+type failDataConn struct {
+	net.Conn
+}
+
+func (c failDataConn) Write(data []byte) (int, error) {
+	if len(data) >= 2 && data[0] == 0x10 && data[1] == 0 {
+		return 0, errors.New("client gone")
+	}
+	return c.Conn.Write(data)
+}
+
+func TestClientWriteErrorEndsSession(t *testing.T) {
+	cfg, pppd := fakePPPD(t, "cat \"$0.frame\"\n"+idlePPPD)
+	if err := os.WriteFile(pppd+".frame", pppEscape([]byte{0xff, 0x03, 0xc0, 0x21, 9, 1, 0, 8, 0, 0, 0, 0}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg)
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	settings, err := newListenerSettings(cfg.Listeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.handleConnection(failDataConn{serverConn}, settings)
+	handshakeSSTP(t, client)
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	expectClosed(t, client)
+}
+
+func TestPPPDWriteErrorAbortsSession(t *testing.T) {
+	// pppd stops reading without exiting
+	cfg, _ := fakePPPD(t, "exec 0<&-\nwhile :; do sleep 0.05; done\n")
+	client := pipeSSTP(t, newServer(cfg))
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	go func() {
+		for {
+			if _, err := client.Write(packDataPacketFast(make([]byte, 100))); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	expectAbortStatus(t, client, StatusNoError)
+}
+
+func TestSyncFraming(t *testing.T) {
+	// The fake pppd records its arguments and sends a frame, unframed on its pty in sync mode
+	cfg, pppd := fakePPPD(t, "echo \"$@\" > \"$0.args\"\n"+
+		"if [ \"$2\" = sync ]; then cat \"$0.sync-frame\" > \"$1\"; else cat \"$0.frame\"; fi\n"+idlePPPD)
+	frame := []byte{0xff, 0x03, 0xc0, 0x21, 9, 1, 0, 8, 0, 0, 0, 0}
+	for name, contents := range map[string][]byte{".frame": pppEscape(frame), ".sync-frame": frame} {
+		if err := os.WriteFile(pppd+name, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.PPP.Framing = pppFramingSync
+	client := pipeSSTP(t, newServer(cfg))
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	if isControl, data := readTestPacket(t, client); isControl || !bytes.Equal(data, frame) {
+		t.Fatalf("expected the frame from pppd, got %x", data)
+	}
+	args, _ := os.ReadFile(pppd + ".args")
+	// Without N_HDLC, as in most containers, sessions fall back to async framing
+	expected := "notty "
+	if pty, _, err := openSyncPTY(); err == nil {
+		pty.Close()
+		expected = "/dev/pts/"
+	}
+	if !bytes.HasPrefix(args, []byte(expected)) {
+		t.Fatalf("expected pppd arguments starting %q, got %q", expected, args)
+	}
+}
+
+// Frames pass through unchanged in sync mode, one per read or write on the pty
+func TestSyncFrames(t *testing.T) {
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	s := newSession(newServer(defaultConfig()), serverConn)
+	go s.run()
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, client, MessageTypeEchoResponse)
+
+	frames := [][]byte{{0xff, 0x03, 0x00, 0x21, flagSequence, controlEscape, 0x01}, {0xff, 0x03, 0x80, 0x21, 0x01}}
+	fromPPPD, pppdOut := io.Pipe()
+	defer pppdOut.Close()
+	go s.readSyncPPPD(fromPPPD)
+	for _, frame := range frames {
+		pppdOut.Write(frame)
+		if isControl, data := readTestPacket(t, client); isControl || !bytes.Equal(data, frame) {
+			t.Fatalf("expected %x, got %x", frame, data)
+		}
+	}
+
+	toPPPD, pppdIn := io.Pipe()
+	stopping := make(chan struct{})
+	defer close(stopping)
+	go s.writePPPD(pppdIn, true, stopping, s.done)
+	buf := make([]byte, maxFrameSize)
+	for _, frame := range frames {
+		packet := newPooledFrame(len(frame))
+		copy(packet.data, frame)
+		s.upstream.push(s, packet)
+		if n, _ := toPPPD.Read(buf); !bytes.Equal(buf[:n], frame) {
+			t.Fatalf("expected %x, got %x", frame, buf[:n])
+		}
+	}
+}
+
+// benchClient reads packets from a session, taking delay over each data packet to model a
+// slow client, and reports control messages on control
+func benchClient(conn net.Conn, delay time.Duration, control chan<- MessageType) {
+	var header [4]byte
+	data := make([]byte, maxFrameSize)
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		isControl, length, err := decodeHeader(header[:])
+		if err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, data[:length]); err != nil {
+			return
+		}
+		if isControl {
+			parsed, err := parseControl(data[:length])
+			if err == nil {
+				control <- parsed.MessageType
+			}
+		} else if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// pipeSession runs a session without pppd on one end of a pipe, with a client reading at the
+// pace set by delay, and returns it once it is answering control messages
+func pipeSession(tb testing.TB, policy string, delay time.Duration) (*session, net.Conn, <-chan MessageType) {
+	cfg := defaultConfig()
+	cfg.Queues.Policy = policy
+	client, serverConn := net.Pipe()
+	s := newSession(newServer(cfg), serverConn)
+	go func() {
+		s.run()
+		serverConn.Close()
+	}()
+	control := make(chan MessageType, 1)
+	go benchClient(client, delay, control)
+	tb.Cleanup(func() { client.Close() })
+
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	if messageType := <-control; messageType != MessageTypeEchoResponse {
+		tb.Fatalf("expected EchoResponse, got %v", messageType)
+	}
+	return s, client, control
+}
+
+func TestForwardingAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures allocations")
+	}
+	s, _, _ := pipeSession(t, queuePolicyBlock, 0)
+	handler := packetHandler{s}
+	frame := make([]byte, 1400)
+	if allocs := testing.AllocsPerRun(1000, func() { handler.Write(frame) }); allocs > 0 {
+		t.Errorf("forwarding a frame to the client allocated %v times", allocs)
+	}
+
+	stopping := make(chan struct{})
+	defer close(stopping)
+	go s.writePPPD(io.Discard, false, stopping, s.done)
+	if allocs := testing.AllocsPerRun(1000, func() {
+		frame := newPooledFrame(1400)
+		s.upstream.push(s, frame)
+	}); allocs > 0 {
+		t.Errorf("forwarding a frame to pppd allocated %v times", allocs)
+	}
+}
+
+func benchmarkDownstream(b *testing.B, policy string, delay time.Duration) {
+	s, _, _ := pipeSession(b, policy, delay)
+	handler := packetHandler{s}
+	frame := make([]byte, 1400)
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.Write(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Frames from pppd to a client reading as fast as it can
+func BenchmarkDownstream(b *testing.B) {
+	benchmarkDownstream(b, queuePolicyBlock, 0)
+}
+
+// With data logging on, frames shorter than a PPP header are dumped rather than crashing the server
+func TestLogShortDataPacket(t *testing.T) {
+	logs := &logBuffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logDataFrames = true
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		logDataFrames = false
+	})
+	cfg, _ := fakePPPD(t, idlePPPD)
+	client := pipeSSTP(t, newServer(cfg))
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	client.Write([]byte{0x10, 0x00, 0x00, 0x06, 0xc0, 0x21})
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, client, MessageTypeEchoResponse)
+	if output := logs.String(); !strings.Contains(output, `msg="read data packet"`) || !strings.Contains(output, `ppp="malformed LCP`) {
+		t.Errorf("expected the short packet to be dumped, got:\n%s", output)
+	}
+}
+
+// Frames from pppd to a slow client: blocking limits pppd to the client's pace, dropping doesn't
+func BenchmarkDownstreamSlowClient(b *testing.B) {
+	b.Run("block", func(b *testing.B) { benchmarkDownstream(b, queuePolicyBlock, 20*time.Microsecond) })
+	b.Run("drop", func(b *testing.B) { benchmarkDownstream(b, queuePolicyDrop, 20*time.Microsecond) })
+}
+
+// Round trip time of an echo to a slow client while pppd floods it with data
+func BenchmarkEchoLatencySlowClient(b *testing.B) {
+	for _, policy := range []string{queuePolicyBlock, queuePolicyDrop} {
+		b.Run(policy, func(b *testing.B) {
+			s, client, control := pipeSession(b, policy, 20*time.Microsecond)
+			go func() {
+				handler := packetHandler{s}
+				frame := make([]byte, 1400)
+				for {
+					if _, err := handler.Write(frame); err != nil {
+						return
+					}
+					// pppd is another process, so it doesn't starve the session
+					runtime.Gosched()
+				}
+			}()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.Write(controlPacket(MessageTypeEchoRequest))
+				<-control
+			}
+		})
+	}
+}
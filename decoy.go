@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request bodies left unread by the decoy handler are discarded up to this size to keep the
+// connection alive; larger ones close the connection
+const maxDiscardedBody = 256 << 10
+
+// httpRequest is a request line and headers read before deciding whether a request is SSTP
+type httpRequest struct {
+	method string
+	target string
+	proto  string
+	header textproto.MIMEHeader
+}
+
+func readHTTPRequest(reader *bufio.Reader) (*httpRequest, error) {
+	headerReader := textproto.NewReader(reader)
+	requestLine, err := headerReader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(requestLine)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return nil, fmt.Errorf("malformed request line %q", requestLine)
+	}
+	header, err := headerReader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &httpRequest{fields[0], fields[1], fields[2], header}, nil
+}
+
+// newDecoyHandler builds the handler for requests which aren't SSTP, or returns nil if none is configured
+func newDecoyHandler(cfg decoyConfig) (http.Handler, error) {
+	switch {
+	case cfg.Static != "":
+		return http.FileServer(http.Dir(cfg.Static)), nil
+	case cfg.Redirect != "":
+		return http.RedirectHandler(cfg.Redirect, http.StatusFound), nil
+	case cfg.Proxy != "":
+		target, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+		return proxy, nil
+	}
+	return nil, nil
+}
+
+// serveDecoy answers a request which isn't SSTP with handler, returning whether the
+// connection can be kept alive for another request
+func serveDecoy(handler http.Handler, c net.Conn, reader *bufio.Reader, remote net.Addr, request *httpRequest) (keepAlive bool, err error) {
+	major, minor, ok := http.ParseHTTPVersion(request.proto)
+	if !ok {
+		return false, fmt.Errorf("unsupported protocol %q", request.proto)
+	}
+	requestURL, err := url.ParseRequestURI(request.target)
+	if err != nil {
+		return false, err
+	}
+	req := &http.Request{
+		Method:     request.method,
+		URL:        requestURL,
+		Proto:      request.proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     http.Header(request.header),
+		Host:       request.header.Get("Host"),
+		RemoteAddr: remote.String(),
+		RequestURI: request.target,
+		Body:       http.NoBody,
+	}
+
+	keepAlive = major == 1 && minor >= 1 && !strings.EqualFold(req.Header.Get("Connection"), "close")
+	chunked := strings.EqualFold(req.Header.Get("Transfer-Encoding"), "chunked")
+	if chunked {
+		req.Body = io.NopCloser(httputil.NewChunkedReader(reader))
+		req.ContentLength = -1
+	} else if value := req.Header.Get("Content-Length"); value != "" {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			return false, fmt.Errorf("invalid Content-Length %q", value)
+		}
+		req.Body = io.NopCloser(io.LimitReader(reader, length))
+		req.ContentLength = length
+	}
+	req.Close = !keepAlive
+
+	response := &decoyResponse{
+		writer:    bufio.NewWriter(c),
+		header:    make(http.Header),
+		headOnly:  req.Method == http.MethodHead,
+		chunkable: major == 1 && minor >= 1,
+		close:     !keepAlive,
+	}
+	handler.ServeHTTP(response, req)
+	err = response.finish()
+	if err != nil {
+		return false, err
+	}
+
+	// Skip any body the handler didn't read, so the next request starts in the right place
+	if n, err := io.CopyN(io.Discard, req.Body, maxDiscardedBody); err != io.EOF || n == maxDiscardedBody {
+		return false, nil
+	}
+	if chunked {
+		// The chunked reader stops before the trailer section
+		if _, err := textproto.NewReader(reader).ReadMIMEHeader(); err != nil {
+			return false, nil
+		}
+	}
+	return !response.close, nil
+}
+
+// decoyResponse is a minimal HTTP/1.1 http.ResponseWriter, supporting keep-alive
+type decoyResponse struct {
+	writer      *bufio.Writer
+	header      http.Header
+	headOnly    bool
+	chunkable   bool
+	close       bool
+	wroteHeader bool
+	status      int
+	chunked     bool
+	// contentLength is the length the handler declared, or -1
+	contentLength int64
+	written       int64
+}
+
+func (r *decoyResponse) Header() http.Header {
+	return r.header
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func (r *decoyResponse) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+
+	r.contentLength = -1
+	if value := r.header.Get("Content-Length"); value != "" {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && length >= 0 {
+			r.contentLength = length
+		} else {
+			r.header.Del("Content-Length")
+		}
+	}
+	if r.contentLength < 0 && bodyAllowed(status) && !r.headOnly {
+		if r.chunkable {
+			r.chunked = true
+			r.header.Set("Transfer-Encoding", "chunked")
+		} else {
+			// The end of the body can only be marked by closing the connection
+			r.close = true
+		}
+	}
+	if r.close {
+		r.header.Set("Connection", "close")
+	}
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	fmt.Fprintf(r.writer, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	r.header.Write(r.writer)
+	r.writer.WriteString("\r\n")
+}
+
+func (r *decoyResponse) Write(data []byte) (int, error) {
+	if !r.wroteHeader {
+		if r.header.Get("Content-Type") == "" {
+			r.header.Set("Content-Type", http.DetectContentType(data))
+		}
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.headOnly || !bodyAllowed(r.status) {
+		return len(data), nil
+	}
+	if r.contentLength >= 0 && r.written+int64(len(data)) > r.contentLength {
+		return 0, http.ErrContentLength
+	}
+	r.written += int64(len(data))
+	if r.chunked {
+		if len(data) == 0 {
+			return 0, nil
+		}
+		fmt.Fprintf(r.writer, "%x\r\n", len(data))
+		r.writer.Write(data)
+		_, err := r.writer.WriteString("\r\n")
+		return len(data), err
+	}
+	return r.writer.Write(data)
+}
+
+func (r *decoyResponse) Flush() {
+	r.writer.Flush()
+}
+
+func (r *decoyResponse) finish() error {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.chunked {
+		r.writer.WriteString("0\r\n\r\n")
+	}
+	if r.contentLength >= 0 && r.written != r.contentLength && !r.headOnly && bodyAllowed(r.status) {
+		// The client is still waiting for the rest of the body
+		r.close = true
+		r.writer.Flush()
+		return errors.New("handler wrote less than its Content-Length")
+	}
+	return r.writer.Flush()
+}
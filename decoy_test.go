@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readDecoyResponse(t *testing.T, reader *bufio.Reader, method string) (*http.Response, string) {
+	response, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		t.Fatalf("reading decoy response: %v", err)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("reading decoy response body: %v", err)
+	}
+	return response, string(body)
+}
+
+func TestDecoyStaticKeepAlive(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>It works!</h1>\n"), 0644)
+
+	cfg := defaultConfig()
+	cfg.Decoy.Static = root
+	addr := startTestServer(t, cfg)
+	conn := dialTest(t, addr)
+	reader := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: vpn.example.com\r\n\r\n")
+	response, body := readDecoyResponse(t, reader, http.MethodGet)
+	if response.StatusCode != http.StatusOK || body != "<h1>It works!</h1>\n" {
+		t.Fatalf("unexpected response %d %q", response.StatusCode, body)
+	}
+	if response.Close {
+		t.Fatal("keep-alive connection was closed")
+	}
+
+	io.WriteString(conn, "HEAD /index.html HTTP/1.1\r\nHost: vpn.example.com\r\n\r\n")
+	response, body = readDecoyResponse(t, reader, http.MethodHead)
+	if response.StatusCode != http.StatusMovedPermanently || body != "" {
+		t.Fatalf("unexpected HEAD response %d %q", response.StatusCode, body)
+	}
+
+	// An unread chunked body is skipped before the next request
+	io.WriteString(conn, "POST /missing HTTP/1.1\r\nHost: vpn.example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	response, _ = readDecoyResponse(t, reader, http.MethodPost)
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected response %d for missing file", response.StatusCode)
+	}
+
+	// The same connection can still become an SSTP session
+	if reader.Buffered() != 0 {
+		t.Fatalf("%d unexpected bytes after decoy responses", reader.Buffered())
+	}
+	handshakeSSTP(t, conn)
+	conn.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, conn, MessageTypeEchoResponse)
+}
+
+func TestDecoyRedirect(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Decoy.Redirect = "https://www.example.com/"
+	addr := startTestServer(t, cfg)
+	conn := dialTest(t, addr)
+
+	io.WriteString(conn, "GET /login HTTP/1.0\r\n\r\n")
+	response, _ := readDecoyResponse(t, bufio.NewReader(conn), http.MethodGet)
+	if response.StatusCode != http.StatusFound || response.Header.Get("Location") != "https://www.example.com/" {
+		t.Fatalf("unexpected response %d to %q", response.StatusCode, response.Header.Get("Location"))
+	}
+	// HTTP/1.0 isn't kept alive
+	expectClosed(t, conn)
+}
+
+func TestNoDecoy(t *testing.T) {
+	addr := startTestServer(t, defaultConfig())
+	conn := dialTest(t, addr)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	response, _ := readDecoyResponse(t, bufio.NewReader(conn), http.MethodGet)
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected response %d without a decoy", response.StatusCode)
+	}
+	expectClosed(t, conn)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PPP protocol numbers the dissector decodes, besides LCP, PAP and CHAP
+const (
+	pppProtocolIPv4   = 0x0021
+	pppProtocolIPv6   = 0x0057
+	pppProtocolIPCP   = 0x8021
+	pppProtocolIPV6CP = 0x8057
+	pppProtocolCCP    = 0x80fd
+	pppProtocolEAP    = 0xc227
+)
+
+var pppProtocolNames = map[uint16]string{
+	pppProtocolIPv4:   "IPv4",
+	pppProtocolIPv6:   "IPv6",
+	0x00fd:            "Compressed-Datagram",
+	pppProtocolIPCP:   "IPCP",
+	pppProtocolIPV6CP: "IPV6CP",
+	pppProtocolCCP:    "CCP",
+	pppProtocolLCP:    "LCP",
+	pppProtocolPAP:    "PAP",
+	pppProtocolCHAP:   "CHAP",
+	pppProtocolEAP:    "EAP",
+}
+
+func pppProtocolName(protocol uint16) string {
+	if name, ok := pppProtocolNames[protocol]; ok {
+		return name
+	}
+	return fmt.Sprintf("protocol %#04x", protocol)
+}
+
+var errTruncated = errors.New("truncated")
+
+// pppFrame is a decoded PPP frame. Packet is a *cpPacket for LCP, IPCP, IPV6CP and CCP, a
+// *papPacket, a *chapPacket, an *ipv4Header or an *ipv6Header, or nil for other protocols.
+type pppFrame struct {
+	Protocol uint16
+	Packet   interface{}
+	Length   int // of the packet after the protocol field
+}
+
+// decodePPP dissects a frame, with or without address/control and protocol field compression
+func decodePPP(frame []byte) (pppFrame, error) {
+	protocol, packet, ok := pppHeader(frame)
+	if !ok {
+		return pppFrame{}, errors.New("no valid protocol field")
+	}
+	f := pppFrame{Protocol: protocol, Length: len(packet)}
+	var err error
+	switch protocol {
+	case pppProtocolLCP, pppProtocolIPCP, pppProtocolIPV6CP, pppProtocolCCP:
+		f.Packet, err = decodeCP(protocol, packet)
+	case pppProtocolPAP:
+		f.Packet, err = decodePAP(packet)
+	case pppProtocolCHAP:
+		f.Packet, err = decodeCHAP(packet)
+	case pppProtocolIPv4:
+		f.Packet, err = decodeIPv4(packet)
+	case pppProtocolIPv6:
+		f.Packet, err = decodeIPv6(packet)
+	}
+	if err != nil {
+		// Leave out the partly decoded packet, which may be a nil pointer
+		f.Packet = nil
+		return f, fmt.Errorf("%s: %w", pppProtocolName(protocol), err)
+	}
+	return f, nil
+}
+
+func (f pppFrame) String() string {
+	if stringer, ok := f.Packet.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%s, %d bytes", pppProtocolName(f.Protocol), f.Length)
+}
+
+// controlPacket returns the packet of an LCP, IPCP, IPV6CP or CCP frame
+func (f pppFrame) controlPacket(protocol uint16) (*cpPacket, bool) {
+	packet, ok := f.Packet.(*cpPacket)
+	return packet, ok && packet.Protocol == protocol
+}
+
+// pppDump is a frame decoded lazily for logging, like hexDump
+type pppDump []byte
+
+func (d pppDump) LogValue() slog.Value {
+	f, err := decodePPP(d)
+	if err != nil {
+		return slog.StringValue(fmt.Sprintf("malformed %s", err))
+	}
+	return slog.StringValue(f.String())
+}
+
+/* RFC 1661
+ * 5. LCP Packet Formats
+ * https://tools.ietf.org/html/rfc1661#section-5
+ * IPCP (RFC 1332, 1877), IPV6CP (RFC 5072) and CCP (RFC 1962) share the format
+ */
+
+// cpPacket is a packet of LCP or a protocol sharing its format
+type cpPacket struct {
+	Protocol uint16
+	Code     byte
+	ID       byte
+	Options  []cpOption // Configure-Request, -Ack, -Nak and -Reject
+	Data     []byte     // other codes, e.g. an Echo-Request's magic number
+}
+
+type cpOption struct {
+	Type byte
+	Data []byte
+}
+
+var cpCodeNames = []string{
+	1: "Configure-Request", 2: "Configure-Ack", 3: "Configure-Nak", 4: "Configure-Reject",
+	5: "Terminate-Request", 6: "Terminate-Ack", 7: "Code-Reject", 8: "Protocol-Reject",
+	9: "Echo-Request", 10: "Echo-Reply", 11: "Discard-Request", 12: "Identification",
+	13: "Time-Remaining", 14: "Reset-Request", 15: "Reset-Ack",
+}
+
+var cpOptionNames = map[uint16]map[byte]string{
+	pppProtocolLCP: {
+		1: "MRU", lcpOptionACCM: "ACCM", 3: "Auth-Protocol", 4: "Quality-Protocol",
+		5: "Magic-Number", lcpOptionPFC: "PFC", lcpOptionACFC: "ACFC", 13: "Callback",
+		17: "MRRU", 18: "Short-Sequence", 19: "Endpoint-Discriminator",
+	},
+	pppProtocolIPCP: {
+		2: "IP-Compression-Protocol", 3: "IP-Address",
+		129: "Primary-DNS", 130: "Primary-NBNS", 131: "Secondary-DNS", 132: "Secondary-NBNS",
+	},
+	pppProtocolIPV6CP: {1: "Interface-Identifier", 2: "IPv6-Compression-Protocol"},
+	pppProtocolCCP:    {17: "Stac-LZS", 18: "MPPE", 24: "Deflate", 26: "Deflate"},
+}
+
+func decodeCP(protocol uint16, data []byte) (*cpPacket, error) {
+	if len(data) < 4 {
+		return nil, errTruncated
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < 4 || length > len(data) {
+		return nil, fmt.Errorf("bad length %d", length)
+	}
+	p := &cpPacket{Protocol: protocol, Code: data[0], ID: data[1]}
+	data = data[4:length]
+	if p.Code < lcpConfigureRequest || p.Code > 4 {
+		p.Data = data
+		return p, nil
+	}
+	for len(data) > 0 {
+		if len(data) < 2 || data[1] < 2 || int(data[1]) > len(data) {
+			return p, fmt.Errorf("bad option at %d", length-len(data))
+		}
+		p.Options = append(p.Options, cpOption{data[0], data[2:data[1]]})
+		data = data[data[1]:]
+	}
+	return p, nil
+}
+
+// option returns the data of the first option of a type
+func (p *cpPacket) option(optionType byte) ([]byte, bool) {
+	for _, option := range p.Options {
+		if option.Type == optionType {
+			return option.Data, true
+		}
+	}
+	return nil, false
+}
+
+// mru returns the MRU in an LCP Configure packet, or the default if it has none
+func (p *cpPacket) mru() int {
+	if value, ok := p.option(1); ok && len(value) == 2 {
+		return int(binary.BigEndian.Uint16(value))
+	}
+	return 1500
+}
+
+// authMethod returns the authentication method asked for in an LCP Configure packet
+func (p *cpPacket) authMethod() (string, bool) {
+	value, ok := p.option(3)
+	if !ok || len(value) < 2 {
+		return "", false
+	}
+	switch protocol := binary.BigEndian.Uint16(value); {
+	case protocol == pppProtocolPAP:
+		return "pap", true
+	case protocol == pppProtocolEAP:
+		return "eap", true
+	case protocol == pppProtocolCHAP && len(value) == 3:
+		switch value[2] {
+		case 5:
+			return "chap_md5", true
+		case 0x80:
+			return "mschap", true
+		case 0x81:
+			return "mschapv2", true
+		}
+	}
+	return "other", true
+}
+
+func (p *cpPacket) String() string {
+	var b strings.Builder
+	b.WriteString(pppProtocolName(p.Protocol))
+	if int(p.Code) < len(cpCodeNames) && cpCodeNames[p.Code] != "" {
+		b.WriteString(" " + cpCodeNames[p.Code])
+	} else {
+		fmt.Fprintf(&b, " code %d", p.Code)
+	}
+	fmt.Fprintf(&b, " id=%d", p.ID)
+	for _, option := range p.Options {
+		b.WriteString(" [" + option.format(p.Protocol) + "]")
+	}
+	if len(p.Data) > 0 {
+		fmt.Fprintf(&b, " data=%x", p.Data)
+	}
+	return b.String()
+}
+
+func (o cpOption) format(protocol uint16) string {
+	name, ok := cpOptionNames[protocol][o.Type]
+	if !ok {
+		name = "option " + strconv.Itoa(int(o.Type))
+	}
+	switch {
+	case len(o.Data) == 0:
+		return name
+	case protocol == pppProtocolLCP && o.Type == 3 && len(o.Data) >= 2:
+		authProtocol := binary.BigEndian.Uint16(o.Data)
+		if len(o.Data) == 3 && authProtocol == pppProtocolCHAP {
+			return fmt.Sprintf("%s CHAP %s", name, chapAlgorithmName(o.Data[2]))
+		}
+		return name + " " + pppProtocolName(authProtocol)
+	case len(o.Data) == 2:
+		return fmt.Sprintf("%s %d", name, binary.BigEndian.Uint16(o.Data))
+	case protocol == pppProtocolIPCP && len(o.Data) == 4:
+		return fmt.Sprintf("%s %s", name, netip.AddrFrom4([4]byte(o.Data)))
+	}
+	return fmt.Sprintf("%s %x", name, o.Data)
+}
+
+func chapAlgorithmName(algorithm byte) string {
+	switch algorithm {
+	case 5:
+		return "MD5"
+	case 0x80:
+		return "MS-CHAP"
+	case 0x81:
+		return "MS-CHAPv2"
+	}
+	return fmt.Sprintf("algorithm %#x", algorithm)
+}
+
+/* RFC 1334
+ * 2.2. Password Authentication Protocol (PAP) Packet Format
+ * https://tools.ietf.org/html/rfc1334#section-2.2
+ */
+
+// papPacket is a PAP packet. Passwords aren't kept, so decoded packets are safe to log.
+type papPacket struct {
+	Code    byte
+	ID      byte
+	PeerID  string // Authenticate-Request
+	Message string // Authenticate-Ack and -Nak
+}
+
+func decodePAP(data []byte) (*papPacket, error) {
+	if len(data) < 4 {
+		return nil, errTruncated
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < 4 || length > len(data) {
+		return nil, fmt.Errorf("bad length %d", length)
+	}
+	p := &papPacket{Code: data[0], ID: data[1]}
+	data = data[4:length]
+	if len(data) < 1 || 1+int(data[0]) > len(data) {
+		return p, errTruncated
+	}
+	if p.Code == 1 {
+		p.PeerID = string(data[1 : 1+data[0]])
+	} else {
+		p.Message = string(data[1 : 1+data[0]])
+	}
+	return p, nil
+}
+
+func (p *papPacket) String() string {
+	switch p.Code {
+	case 1:
+		return fmt.Sprintf("PAP Authenticate-Request id=%d peer=%q", p.ID, p.PeerID)
+	case 2:
+		return fmt.Sprintf("PAP Authenticate-Ack id=%d message=%q", p.ID, p.Message)
+	case 3:
+		return fmt.Sprintf("PAP Authenticate-Nak id=%d message=%q", p.ID, p.Message)
+	}
+	return fmt.Sprintf("PAP code %d id=%d", p.Code, p.ID)
+}
+
+/* RFC 1994
+ * 4. Packet Formats
+ * https://tools.ietf.org/html/rfc1994#section-4
+ * MS-CHAPv2 (RFC 2759) uses the same packets, with a 49 byte Response value
+ */
+
+// chapPacket is a CHAP packet, including MS-CHAP and MS-CHAPv2. Challenge and response values
+// are only kept as lengths, so decoded packets are safe to log.
+type chapPacket struct {
+	Code        byte
+	ID          byte
+	ValueLength int    // Challenge and Response
+	Name        string // Challenge and Response
+	Message     string // Success and Failure
+}
+
+const msCHAPv2ResponseLength = 49
+
+func decodeCHAP(data []byte) (*chapPacket, error) {
+	if len(data) < 4 {
+		return nil, errTruncated
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < 4 || length > len(data) {
+		return nil, fmt.Errorf("bad length %d", length)
+	}
+	p := &chapPacket{Code: data[0], ID: data[1]}
+	data = data[4:length]
+	switch p.Code {
+	case 1, 2:
+		if len(data) < 1 || 1+int(data[0]) > len(data) {
+			return p, errTruncated
+		}
+		p.ValueLength = int(data[0])
+		p.Name = string(data[1+data[0]:])
+	default:
+		p.Message = string(data)
+	}
+	return p, nil
+}
+
+// msCHAPv2Error returns the error code of an MS-CHAPv2 Failure, e.g. 691 for bad credentials
+func (p *chapPacket) msCHAPv2Error() (int, bool) {
+	if p.Code != 4 {
+		return 0, false
+	}
+	for _, field := range strings.Fields(p.Message) {
+		if code, ok := strings.CutPrefix(field, "E="); ok {
+			n, err := strconv.Atoi(code)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+func (p *chapPacket) String() string {
+	switch p.Code {
+	case 1:
+		return fmt.Sprintf("CHAP Challenge id=%d name=%q value=%d bytes", p.ID, p.Name, p.ValueLength)
+	case 2:
+		s := fmt.Sprintf("CHAP Response id=%d name=%q value=%d bytes", p.ID, p.Name, p.ValueLength)
+		if p.ValueLength == msCHAPv2ResponseLength {
+			s += " (MS-CHAPv2)"
+		}
+		return s
+	case 3:
+		return fmt.Sprintf("CHAP Success id=%d message=%q", p.ID, p.Message)
+	case 4:
+		if code, ok := p.msCHAPv2Error(); ok {
+			return fmt.Sprintf("CHAP Failure id=%d error=%d message=%q", p.ID, code, p.Message)
+		}
+		return fmt.Sprintf("CHAP Failure id=%d message=%q", p.ID, p.Message)
+	}
+	return fmt.Sprintf("CHAP code %d id=%d", p.Code, p.ID)
+}
+
+// ipv4Header is the start of an IPv4 packet, with ports for TCP and UDP
+type ipv4Header struct {
+	Length   int
+	TTL      byte
+	Protocol byte
+	Src, Dst netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+func decodeIPv4(data []byte) (*ipv4Header, error) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return nil, errors.New("not an IPv4 header")
+	}
+	h := &ipv4Header{
+		Length:   int(binary.BigEndian.Uint16(data[2:4])),
+		TTL:      data[8],
+		Protocol: data[9],
+		Src:      netip.AddrFrom4([4]byte(data[12:16])),
+		Dst:      netip.AddrFrom4([4]byte(data[16:20])),
+	}
+	if headerLength := int(data[0]&0x0f) * 4; headerLength >= 20 && headerLength <= len(data) {
+		h.SrcPort, h.DstPort = transportPorts(h.Protocol, data[headerLength:])
+	}
+	return h, nil
+}
+
+func (h *ipv4Header) String() string {
+	return fmt.Sprintf("IPv4 %s %s > %s length=%d ttl=%d", ipProtocolName(h.Protocol),
+		netip.AddrPortFrom(h.Src, h.SrcPort), netip.AddrPortFrom(h.Dst, h.DstPort), h.Length, h.TTL)
+}
+
+// ipv6Header is the fixed IPv6 header, with ports for TCP and UDP straight after it
+type ipv6Header struct {
+	PayloadLength int
+	NextHeader    byte
+	HopLimit      byte
+	Src, Dst      netip.Addr
+	SrcPort       uint16
+	DstPort       uint16
+}
+
+func decodeIPv6(data []byte) (*ipv6Header, error) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return nil, errors.New("not an IPv6 header")
+	}
+	h := &ipv6Header{
+		PayloadLength: int(binary.BigEndian.Uint16(data[4:6])),
+		NextHeader:    data[6],
+		HopLimit:      data[7],
+		Src:           netip.AddrFrom16([16]byte(data[8:24])),
+		Dst:           netip.AddrFrom16([16]byte(data[24:40])),
+	}
+	h.SrcPort, h.DstPort = transportPorts(h.NextHeader, data[40:])
+	return h, nil
+}
+
+func (h *ipv6Header) String() string {
+	return fmt.Sprintf("IPv6 %s %s > %s length=%d hop_limit=%d", ipProtocolName(h.NextHeader),
+		netip.AddrPortFrom(h.Src, h.SrcPort), netip.AddrPortFrom(h.Dst, h.DstPort), h.PayloadLength, h.HopLimit)
+}
+
+// transportPorts returns the ports of a TCP or UDP header, or zeros
+func transportPorts(protocol byte, data []byte) (uint16, uint16) {
+	if (protocol == 6 || protocol == 17) && len(data) >= 4 {
+		return binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4])
+	}
+	return 0, 0
+}
+
+func ipProtocolName(protocol byte) string {
+	switch protocol {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 58:
+		return "icmpv6"
+	}
+	return "protocol " + strconv.Itoa(int(protocol))
+}
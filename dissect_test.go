@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDecodeCapturedLCP(t *testing.T) {
+	// test.txt is an LCP Configure-Request followed by its FCS
+	captured := readHexDump(t, "test.txt")
+	f, err := decodePPP(captured[:len(captured)-2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "LCP Configure-Request id=1 [ACCM 00000000] [Auth-Protocol CHAP MS-CHAPv2] [Magic-Number 43cb5fba] [PFC] [ACFC]"
+	if f.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, f)
+	}
+	lcp, ok := f.controlPacket(pppProtocolLCP)
+	if !ok {
+		t.Fatalf("expected an LCP packet, got %T", f.Packet)
+	}
+	if method, _ := lcp.authMethod(); method != "mschapv2" || lcp.mru() != 1500 {
+		t.Errorf("expected mschapv2 and the default MRU, got %s and %d", method, lcp.mru())
+	}
+}
+
+func TestDecodePPP(t *testing.T) {
+	msCHAPv2Response := append([]byte{0xc2, 0x23, 2, 7, 0, 58, 49}, make([]byte, 49)...)
+	tests := []struct {
+		name     string
+		frame    []byte
+		expected string
+	}{
+		{"lcp echo", []byte{0xff, 0x03, 0xc0, 0x21, 9, 4, 0, 8, 0x43, 0xcb, 0x5f, 0xba},
+			"LCP Echo-Request id=4 data=43cb5fba"},
+		{"lcp mru", []byte{0xc0, 0x21, 2, 1, 0, 8, 1, 4, 0x05, 0x78},
+			"LCP Configure-Ack id=1 [MRU 1400]"},
+		{"ipcp", []byte{0x80, 0x21, 3, 2, 0, 16, 3, 6, 10, 0, 0, 2, 129, 6, 192, 0, 2, 53},
+			"IPCP Configure-Nak id=2 [IP-Address 10.0.0.2] [Primary-DNS 192.0.2.53]"},
+		{"ccp", []byte{0x80, 0xfd, 1, 1, 0, 10, 18, 6, 1, 0, 0, 0x40},
+			"CCP Configure-Request id=1 [MPPE 01000040]"},
+		{"pap", []byte{0xc0, 0x23, 1, 3, 0, 13, 4, 'u', 's', 'e', 'r', 3, 'p', 'w', 'd'},
+			`PAP Authenticate-Request id=3 peer="user"`},
+		{"ms-chapv2 response", append(msCHAPv2Response, 'u', 's', 'e', 'r'),
+			`CHAP Response id=7 name="user" value=49 bytes (MS-CHAPv2)`},
+		{"ms-chapv2 failure", append([]byte{0xc2, 0x23, 4, 7, 0, 17}, "E=691 R=0 V=3"...),
+			`CHAP Failure id=7 error=691 message="E=691 R=0 V=3"`},
+		{"ipv4", append([]byte{0x21, 0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 2, 192, 0, 2, 1},
+			0x1f, 0x90, 0x01, 0xbb),
+			"IPv4 tcp 10.0.0.2:8080 > 192.0.2.1:443 length=40 ttl=64"},
+		{"ipv6", append(append([]byte{0x00, 0x57, 0x60, 0, 0, 0, 0, 8, 17, 255},
+			net.ParseIP("2001:db8::2")...), append(net.ParseIP("2001:db8::1"), 0, 53, 0, 53)...),
+			"IPv6 udp [2001:db8::2]:53 > [2001:db8::1]:53 length=8 hop_limit=255"},
+		{"other", []byte{0xff, 0x03, 0x80, 0x53, 1, 2, 3}, "protocol 0x8053, 3 bytes"},
+		{"bad length", []byte{0xc0, 0x21, 1, 1, 0, 40, 1, 4}, "malformed LCP: bad length 40"},
+	}
+	for _, test := range tests {
+		if s := pppDump(test.frame).LogValue().String(); s != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, s)
+		}
+	}
+
+	// Credentials aren't decoded, so they never reach the logs
+	if s := pppDump(msCHAPv2Response).LogValue().String(); strings.Contains(s, "00000000") {
+		t.Errorf("response value logged: %s", s)
+	}
+}
+
+func TestObserveFrameMetrics(t *testing.T) {
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	s := newSession(newServer(defaultConfig()), serverConn)
+	mschapv2 := atomic.LoadUint64(&metricAuthMethods.With("mschapv2").value)
+	metricNegotiatedMRU.mu.Lock()
+	mrus := metricNegotiatedMRU.count
+	metricNegotiatedMRU.mu.Unlock()
+
+	// The client acknowledges pppd's request for MS-CHAPv2, and pppd the client's MRU
+	s.observeFrame("rx", []byte{0xff, 0x03, 0xc0, 0x21, 2, 1, 0, 9, 3, 5, 0xc2, 0x23, 0x81})
+	s.observeFrame("tx", []byte{0xff, 0x03, 0xc0, 0x21, 2, 1, 0, 8, 1, 4, 0x05, 0x78})
+	if atomic.LoadUint64(&metricAuthMethods.With("mschapv2").value) != mschapv2+1 {
+		t.Error("expected the authentication method to be counted")
+	}
+	metricNegotiatedMRU.mu.Lock()
+	defer metricNegotiatedMRU.mu.Unlock()
+	if metricNegotiatedMRU.count != mrus+1 {
+		t.Error("expected the client's MRU to be observed")
+	}
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"slices"
 )
 
 /* RFC 1662
@@ -48,22 +47,36 @@ const pppInitFCS16 = 0xffff // Initial FCS value
 const pppGoodFCS16 = 0xf0b8 // Good final FCS value
 const flagSequence = 0x7e
 const controlEscape = 0x7d
-const maxFrameSize = 2048
+
+// maxFrameSize is the largest PPP frame, without its FCS, an SSTP data packet can carry: SSTP
+// packet lengths are 12 bits and include the 4-byte header
+const maxFrameSize = 1<<12 - 1 - sstpHeaderLength
+
+// escapedLength is the most bytes the HDLC framing of a frame of n bytes can take
+func escapedLength(n int) int {
+	return (n+2)*2 + 2
+}
 
 func pppEscape(inputBytes []byte) []byte {
-	length := (len(inputBytes)+2)*2 + 2
-	currentPos := 0
-	outputBytes := make([]byte, length)
+	return appendEscaped(make([]byte, 0, escapedLength(len(inputBytes))), inputBytes, &defaultAsyncMap)
+}
+
+// appendEscaped appends the HDLC framing of a frame to outputBytes, escaping the characters in
+// m, without allocating if outputBytes has escapedLength bytes to spare
+func appendEscaped(outputBytes []byte, inputBytes []byte, m *asyncMap) []byte {
+	currentPos := len(outputBytes)
+	outputBytes = slices.Grow(outputBytes, escapedLength(len(inputBytes)))
+	outputBytes = outputBytes[:currentPos+escapedLength(len(inputBytes))]
 	var fcs uint16 = pppInitFCS16
 
-	outputBytes[0] = flagSequence
+	outputBytes[currentPos] = flagSequence
 	currentPos++
 
 	for _, v := range inputBytes {
 		// black magic
 		fcs = fcs>>8 ^ fcstab[(fcs^uint16(v))&0xff]
 		// escape byte
-		if v < 0x20 || v == flagSequence || v == controlEscape {
+		if m.escapes(v) {
 			outputBytes[currentPos] = controlEscape
 			currentPos++
 			outputBytes[currentPos] = v ^ 0x20
@@ -77,7 +90,7 @@ func pppEscape(inputBytes []byte) []byte {
 	fcs ^= 0xffff // Complement fcs
 	// Escape first half of fcs
 	fcsFirstHalf := byte(fcs & 0x00ff)
-	if fcsFirstHalf < 0x20 || fcsFirstHalf == flagSequence || fcsFirstHalf == controlEscape {
+	if m.escapes(fcsFirstHalf) {
 		outputBytes[currentPos] = controlEscape
 		currentPos++
 		outputBytes[currentPos] = fcsFirstHalf ^ 0x20
@@ -88,7 +101,7 @@ func pppEscape(inputBytes []byte) []byte {
 	}
 	// Escape second half of fcs
 	fcsSecondHalf := byte(fcs >> 8)
-	if fcsSecondHalf < 0x20 || fcsSecondHalf == flagSequence || fcsSecondHalf == controlEscape {
+	if m.escapes(fcsSecondHalf) {
 		outputBytes[currentPos] = controlEscape
 		currentPos++
 		outputBytes[currentPos] = fcsSecondHalf ^ 0x20
@@ -101,45 +114,114 @@ func pppEscape(inputBytes []byte) []byte {
 	outputBytes[currentPos] = flagSequence
 	currentPos++
 
-	// TODO: check if FCS is good?
-	return outputBytes[0:currentPos]
+	return outputBytes[:currentPos]
 }
 
+// frameError is why a frame from pppd was dropped
+type frameError string
+
+func (e frameError) Error() string {
+	return string(e)
+}
+
+const (
+	errFrameAborted frameError = "aborted"  // an escape directly before a flag, the abort sequence
+	errRuntFrame    frameError = "runt"     // too short to hold a frame and its FCS
+	errFrameTooLong frameError = "too_long" // longer than maxFrameSize and an FCS
+	errBadFCS       frameError = "bad_fcs"
+)
+
+// Shortest frame: a compressed protocol field, a byte of information and the FCS
+const minFrameSize = 4
+
+// pppUnescaper decodes a stream of HDLC-like framing (RFC 1662), such as pppd's output, into
+// frames. It keeps its state between writes, so frames may be split across them in any way.
 type pppUnescaper struct {
+	buf           *frameBuffer // pooled storage for currentPacket
 	currentPacket []byte
-	outputWriter  io.Writer
-	currentPos    int
-	escaped       bool
+	// onFrame is called with each valid frame, without its FCS. The frame is only valid during the call.
+	onFrame func(frame []byte)
+	// onError is called with frames which are dropped, and why
+	onError func(err frameError, frame []byte)
+	// receiveMap, if set, is the ACCM the frames were sent with. Control characters in it which
+	// arrive unescaped were added in transit, and are discarded.
+	receiveMap *asyncMap
+	currentPos int
+	escaped    bool
+	tooLong    bool
+}
+
+func newUnescaper(onFrame func(frame []byte), onError func(err frameError, frame []byte)) *pppUnescaper {
+	buf := getFrameBuffer()
+	return &pppUnescaper{buf: buf, onFrame: onFrame, onError: onError, currentPacket: buf[:maxFrameSize+2]}
 }
 
-func newUnescaper(outputWriter io.Writer) pppUnescaper {
-	return pppUnescaper{outputWriter: outputWriter, currentPacket: make([]byte, maxFrameSize)}
+// release returns the unescaper's buffer to the pool once nothing writes to it any more
+func (p *pppUnescaper) release() {
+	if p != nil {
+		releaseFrameBuffer(p.buf)
+		p.buf = nil
+	}
 }
 
-func (p pppUnescaper) Write(data []byte) (int, error) {
-	bytesWritten := 0
+// fcs16 computes the FCS of a frame; over a frame and its own FCS it gives pppGoodFCS16
+func fcs16(frame []byte) uint16 {
+	var fcs uint16 = pppInitFCS16
+	for _, b := range frame {
+		fcs = fcs>>8 ^ fcstab[(fcs^uint16(b))&0xff]
+	}
+	return fcs
+}
 
+func (p *pppUnescaper) Write(data []byte) (int, error) {
 	for _, v := range data {
-		if p.escaped {
+		switch {
+		case v == flagSequence:
+			p.endFrame()
+		case p.escaped:
 			p.escaped = false
-			p.currentPacket[p.currentPos] = v ^ 0x20
-			p.currentPos++
-		} else if v == controlEscape {
+			p.appendByte(v ^ 0x20)
+		case v == controlEscape:
 			p.escaped = true
-		} else if v == flagSequence {
-			if p.currentPos > 4 {
-				/* Ignore 2 byte FCS field */
-				p.outputWriter.Write(p.currentPacket[:(p.currentPos - 2)])
-				p.currentPos = 0
-			}
-		} else if p.currentPos < maxFrameSize {
-			p.currentPacket[p.currentPos] = v
-			p.currentPos++
-		} else {
-			fmt.Print("Packet trimmed")
+		case v < 0x20 && p.receiveMap != nil && p.receiveMap.escapes(v):
+		default:
+			p.appendByte(v)
 		}
-		bytesWritten++
 	}
+	return len(data), nil
+}
 
-	return bytesWritten, nil
+func (p *pppUnescaper) appendByte(v byte) {
+	if p.currentPos < maxFrameSize+2 {
+		p.currentPacket[p.currentPos] = v
+		p.currentPos++
+	} else {
+		p.tooLong = true
+	}
+}
+
+// endFrame passes on the frame before a flag sequence, without its FCS, if it is valid
+func (p *pppUnescaper) endFrame() {
+	frame := p.currentPacket[:p.currentPos]
+	var err frameError
+	switch {
+	case p.escaped:
+		err = errFrameAborted
+	case p.tooLong:
+		err = errFrameTooLong
+	case len(frame) == 0:
+		// Flags between frames
+	case len(frame) < minFrameSize:
+		err = errRuntFrame
+	case fcs16(frame) != pppGoodFCS16:
+		err = errBadFCS
+	default:
+		p.onFrame(frame[:len(frame)-2])
+	}
+	if err != "" && p.onError != nil {
+		p.onError(err, frame)
+	}
+	p.currentPos = 0
+	p.escaped = false
+	p.tooLong = false
 }
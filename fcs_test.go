@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
 type logWriter struct{}
@@ -14,8 +22,9 @@ func (l logWriter) Write(data []byte) (int, error) {
 func BenchmarkEscape(b *testing.B) {
 	var data = make([]byte, 1024)
 	writer := logWriter{}
-	unescaper := newUnescaper(writer)
+	unescaper := newUnescaper(func(frame []byte) { writer.Write(frame) }, nil)
 	var data2 []byte
+	b.ReportAllocs()
 	for n := 0; n < b.N; n++ {
 		data2 = pppEscape(data)
 		unescaper.Write(data2)
@@ -23,6 +32,36 @@ func BenchmarkEscape(b *testing.B) {
 	//log.Printf("%v", hex.Dump(data2))
 }
 
+// Escaping into pooled buffers, as sessions do
+func BenchmarkEscapePooled(b *testing.B) {
+	var data = make([]byte, 1024)
+	unescaper := newUnescaper(func([]byte) {}, nil)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		buf := getFrameBuffer()
+		unescaper.Write(appendEscaped(buf[:0], data, &defaultAsyncMap))
+		releaseFrameBuffer(buf)
+	}
+}
+
+func BenchmarkPackDataPacket(b *testing.B) {
+	var data = make([]byte, 1024)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		packDataPacketFast(data)
+	}
+}
+
+func BenchmarkPackDataPacketPooled(b *testing.B) {
+	var data = make([]byte, 1024)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		buf := getFrameBuffer()
+		appendDataPacket(buf[:0], data)
+		releaseFrameBuffer(buf)
+	}
+}
+
 func BenchmarkCopy(b *testing.B) {
 	var data = make([]byte, 1024)
 	var data2 = make([]byte, 1024)
@@ -117,3 +156,173 @@ func BenchmarkEscapeTest2(b *testing.B) {
 		}
 	}
 }
+
+// readHexDump reads a file in the format of hex.Dump
+func readHexDump(t *testing.T, path string) []byte {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, line := range strings.Split(string(contents), "\n") {
+		line, _, _ = strings.Cut(line, "|")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		decoded, err := hex.DecodeString(strings.Join(fields[1:], ""))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		data = append(data, decoded...)
+	}
+	return data
+}
+
+// frameRecorder collects the frames and errors from an unescaper
+type frameRecorder struct {
+	frames [][]byte
+	errs   []frameError
+}
+
+func (r *frameRecorder) frame(frame []byte) {
+	r.frames = append(r.frames, append([]byte(nil), frame...))
+}
+
+func (r *frameRecorder) onError(err frameError, frame []byte) {
+	r.errs = append(r.errs, err)
+}
+
+func TestUnescaperFCS(t *testing.T) {
+	// test.txt is an LCP Configure-Request followed by its FCS
+	captured := readHexDump(t, "test.txt")
+	frame := captured[:len(captured)-2]
+	escaped := pppEscape(frame)
+	if fcs16(captured) != pppGoodFCS16 {
+		t.Fatalf("captured FCS %x doesn't check", captured[len(captured)-2:])
+	}
+	var recorder frameRecorder
+	newUnescaper(recorder.frame, recorder.onError).Write(escaped)
+	if len(recorder.frames) != 1 || !bytes.Equal(recorder.frames[0], frame) || len(recorder.errs) != 0 {
+		t.Fatalf("expected the captured frame, got %x, errors %v", recorder.frames, recorder.errs)
+	}
+
+	// test2.txt is a read from pppd's stdout: one escaped frame followed by padding
+	recorder = frameRecorder{}
+	newUnescaper(recorder.frame, recorder.onError).Write(readHexDump(t, "test2.txt"))
+	if len(recorder.frames) != 1 || len(recorder.errs) != 0 {
+		t.Fatalf("expected one frame, got %x, errors %v", recorder.frames, recorder.errs)
+	}
+	if protocol := binary.BigEndian.Uint16(recorder.frames[0][2:4]); protocol != 0xc021 {
+		t.Fatalf("expected LCP, got protocol %#x", protocol)
+	}
+
+	// A corrupted frame is dropped
+	corrupted := append([]byte(nil), escaped...)
+	corrupted[3] ^= 0x01
+	recorder = frameRecorder{}
+	newUnescaper(recorder.frame, recorder.onError).Write(corrupted)
+	if len(recorder.frames) != 0 || len(recorder.errs) != 1 || recorder.errs[0] != errBadFCS {
+		t.Fatalf("expected a bad FCS, got %x, errors %v", recorder.frames, recorder.errs)
+	}
+}
+
+func TestAppendEscapedPrefix(t *testing.T) {
+	frame := []byte{0xff, 0x03, 0xc0, 0x21, 0x09, 0x01, 0x00, 0x08, 0x7d, 0x7e, 0x00, 0x01}
+	prefix := []byte{0xaa, 0xbb, 0xcc}
+	escaped := appendEscaped(append([]byte(nil), prefix...), frame, &defaultAsyncMap)
+	if !bytes.Equal(escaped[:len(prefix)], prefix) {
+		t.Fatalf("prefix overwritten: %x", escaped[:len(prefix)])
+	}
+	if expected := pppEscape(frame); !bytes.Equal(escaped[len(prefix):], expected) {
+		t.Fatalf("expected %x after the prefix, got %x", expected, escaped[len(prefix):])
+	}
+	var recorder frameRecorder
+	newUnescaper(recorder.frame, recorder.onError).Write(escaped[len(prefix):])
+	if len(recorder.errs) != 0 || len(recorder.frames) != 1 || !bytes.Equal(recorder.frames[0], frame) {
+		t.Fatalf("expected %x, got %x, errors %v", frame, recorder.frames, recorder.errs)
+	}
+}
+
+func TestUnescaperMalformedFrames(t *testing.T) {
+	good := pppEscape([]byte{0xff, 0x03, 0xc0, 0x21, 9, 1, 0, 4})
+	tests := map[frameError][]byte{
+		errFrameAborted: {flagSequence, 0xff, 0x03, 0xc0, controlEscape, flagSequence},
+		errRuntFrame:    {flagSequence, 0xff, 0x03, flagSequence},
+		errFrameTooLong: append(append([]byte{flagSequence}, make([]byte, maxFrameSize+3)...), flagSequence),
+	}
+	for expected, data := range tests {
+		var recorder frameRecorder
+		// The next frame is unaffected
+		newUnescaper(recorder.frame, recorder.onError).Write(append(data, good...))
+		if len(recorder.errs) != 1 || recorder.errs[0] != expected {
+			t.Errorf("%s: got errors %v", expected, recorder.errs)
+		}
+		if len(recorder.frames) != 1 {
+			t.Errorf("%s: frame after the malformed one not received: %x", expected, recorder.frames)
+		}
+	}
+}
+
+// randomFrames generates frames rich in bytes which need escaping
+func randomFrames(values []reflect.Value, r *rand.Rand) {
+	special := []byte{flagSequence, controlEscape, 0x00, 0x1f, 0x20, 0x5d, 0x5e, 0xff}
+	frames := make([][]byte, 1+r.Intn(8))
+	for i := range frames {
+		frame := []byte{0xff, 0x03}
+		for n := r.Intn(200); n > 0; n-- {
+			if r.Intn(4) == 0 {
+				frame = append(frame, special[r.Intn(len(special))])
+			} else {
+				frame = append(frame, byte(r.Intn(256)))
+			}
+		}
+		frames[i] = frame
+	}
+	values[0] = reflect.ValueOf(frames)
+}
+
+func TestUnescaperSplitWrites(t *testing.T) {
+	decode := func(writes ...[]byte) frameRecorder {
+		var recorder frameRecorder
+		unescaper := newUnescaper(recorder.frame, recorder.onError)
+		for _, data := range writes {
+			unescaper.Write(data)
+		}
+		return recorder
+	}
+	check := func(frames [][]byte) bool {
+		var stream []byte
+		for _, frame := range frames {
+			stream = append(stream, pppEscape(frame)...)
+		}
+		matches := func(recorder frameRecorder) bool {
+			if len(recorder.errs) != 0 || len(recorder.frames) != len(frames) {
+				return false
+			}
+			for i, frame := range frames {
+				if !bytes.Equal(recorder.frames[i], frame) {
+					return false
+				}
+			}
+			return true
+		}
+
+		// Split the stream at every point
+		for split := 0; split <= len(stream); split++ {
+			if !matches(decode(stream[:split], stream[split:])) {
+				t.Logf("split at %d of %x", split, stream)
+				return false
+			}
+		}
+		// and into single bytes
+		writes := make([][]byte, len(stream))
+		for i := range stream {
+			writes[i] = stream[i : i+1]
+		}
+		return matches(decode(writes...))
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 50, Values: randomFrames}); err != nil {
+		t.Fatal(err)
+	}
+}
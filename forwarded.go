@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+/* Forwarded HTTP Extension, RFC 7239
+ * https://tools.ietf.org/html/rfc7239
+ * and the de facto X-Forwarded-For header
+ */
+
+// forwardedFor returns the client addresses listed by proxies, nearest proxy last.
+// Forwarded takes precedence over X-Forwarded-For.
+func forwardedFor(header textproto.MIMEHeader) []string {
+	var addresses []string
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, address, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					addresses = append(addresses, strings.Trim(address, `"`))
+				}
+			}
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			addresses = append(addresses, strings.TrimSpace(address))
+		}
+	}
+	return addresses
+}
+
+// parseForwardedAddress parses an address from Forwarded or X-Forwarded-For, which may have a port
+// and IPv6 brackets. Obfuscated identifiers and "unknown" return nil.
+func parseForwardedAddress(address string) *net.TCPAddr {
+	if ip := net.ParseIP(address); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	parsedPort, _ := strconv.ParseUint(port, 10, 16)
+	return &net.TCPAddr{IP: ip, Port: int(parsedPort)}
+}
+
+// forwardedClient finds the client address in the forwarding headers, skipping addresses of
+// trusted proxies from the nearest one outwards. It returns nil if there is no usable address.
+func forwardedClient(header textproto.MIMEHeader, trusted []*net.IPNet) net.Addr {
+	addresses := forwardedFor(header)
+	var client *net.TCPAddr
+	for i := len(addresses) - 1; i >= 0; i-- {
+		address := parseForwardedAddress(addresses[i])
+		if address == nil {
+			// Can't see past an address we don't understand
+			break
+		}
+		client = address
+		if !containsIP(trusted, address.IP) {
+			break
+		}
+	}
+	if client == nil {
+		return nil
+	}
+	return client
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
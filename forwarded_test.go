@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestForwardedClient(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	tests := []struct {
+		name     string
+		header   textproto.MIMEHeader
+		expected string
+	}{
+		{"none", textproto.MIMEHeader{}, ""},
+		{"X-Forwarded-For", textproto.MIMEHeader{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7:0"},
+		{"skips trusted proxies", textproto.MIMEHeader{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.2"}}, "203.0.113.7:0"},
+		{"all trusted", textproto.MIMEHeader{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3:0"},
+		{"Forwarded", textproto.MIMEHeader{"Forwarded": {`for=192.0.2.60;proto=https;by=203.0.113.43`}}, "192.0.2.60:0"},
+		{"Forwarded IPv6 with port", textproto.MIMEHeader{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, "[2001:db8:cafe::17]:4711"},
+		{"Forwarded preferred", textproto.MIMEHeader{"Forwarded": {"for=192.0.2.60"}, "X-Forwarded-For": {"203.0.113.7"}}, "192.0.2.60:0"},
+		{"obfuscated", textproto.MIMEHeader{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2:0"},
+		{"unknown", textproto.MIMEHeader{"Forwarded": {"for=unknown"}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := forwardedClient(test.header, trusted)
+			if (client == nil) != (test.expected == "") || (client != nil && client.String() != test.expected) {
+				t.Fatalf("got %v, expected %q", client, test.expected)
+			}
+		})
+	}
+}
+
+// connectedPacket builds a CallConnected echoing the nonce from a CallConnectAck
+func connectedPacket(ack sstpControlHeader, certHash []byte) []byte {
+	data := make([]byte, cryptoBindingLength)
+	data[3] = certHashProtocolSHA256
+	copy(data[4:36], ack.Attributes[0].Data[4:36])
+	copy(data[36:68], certHash)
+	return controlPacket(MessageTypeCallConnected, sstpAttribute{0, AttributeIDCryptoBinding, 4 + cryptoBindingLength, data})
+}
+
+func TestReverseProxyMode(t *testing.T) {
+	certHash := sha256.Sum256([]byte("front end certificate"))
+	otherHash := sha256.Sum256([]byte("another certificate"))
+
+	tests := []struct {
+		name       string
+		trusted    []string
+		certHashes []string
+		headers    string
+		sentHash   []byte
+		remote     string
+		aborted    bool
+	}{
+		{"hash from config", []string{"127.0.0.1"}, []string{hex.EncodeToString(certHash[:])},
+			"X-Forwarded-For: 203.0.113.7\r\n", certHash[:], "203.0.113.7", false},
+		{"hash from header", []string{"127.0.0.1"}, nil,
+			"Forwarded: for=203.0.113.8\r\nX-SSTP-Cert-Hash: " + hex.EncodeToString(certHash[:]) + "\r\n", certHash[:], "203.0.113.8", false},
+		{"wrong hash", []string{"127.0.0.1"}, []string{hex.EncodeToString(certHash[:])},
+			"", otherHash[:], "127.0.0.1", true},
+		{"untrusted proxy", []string{"192.0.2.1"}, nil,
+			"X-Forwarded-For: 203.0.113.7\r\nX-SSTP-Cert-Hash: " + hex.EncodeToString(otherHash[:]) + "\r\n", certHash[:], "127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The fake pppd records its arguments
+			cfg, pppd := fakePPPD(t, "echo \"$@\" > \"$0.args\"\n"+idlePPPD)
+			cfg.Listeners[0].ForwardedTrusted = test.trusted
+			cfg.Listeners[0].CertHashes = test.certHashes
+			cfg.Listeners[0].CertHashHeader = "X-SSTP-Cert-Hash"
+			addr := startTestServer(t, cfg)
+
+			conn := dialTest(t, addr)
+			io.WriteString(conn, "SSTP_DUPLEX_POST "+sstpPath+" HTTP/1.1\r\nHost: test\r\n"+test.headers+"\r\n")
+			readHTTPResponse(t, conn)
+			conn.Write(connectRequestPacket())
+			ack := expectControl(t, conn, MessageTypeCallConnectAck)
+			conn.Write(connectedPacket(ack, test.sentHash))
+
+			if test.aborted {
+				expectAbortStatus(t, conn, StatusValueNotSupported)
+				expectClosed(t, conn)
+				return
+			}
+			// Nothing is sent in reply to CallConnected, so check the session is still up
+			conn.Write(controlPacket(MessageTypeEchoRequest))
+			expectControl(t, conn, MessageTypeEchoResponse)
+
+			var args []byte
+			for start := time.Now(); len(args) == 0 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				args, _ = os.ReadFile(pppd + ".args")
+			}
+			if !bytes.Contains(args, []byte("remotenumber "+test.remote+" ")) {
+				t.Fatalf("expected remotenumber %s in pppd arguments %q", test.remote, args)
+			}
+		})
+	}
+}
+
+func TestCryptoBindingNonce(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+	client.Write(connectRequestPacket())
+	ack := expectControl(t, client, MessageTypeCallConnectAck)
+	if bytes.Equal(ack.Attributes[0].Data[4:36], make([]byte, 32)) {
+		t.Fatal("CallConnectAck nonce is not set")
+	}
+	ack.Attributes[0].Data[4] ^= 0xff
+	client.Write(connectedPacket(ack, nil))
+	expectAbortStatus(t, client, StatusValueNotSupported)
+	expectClosed(t, client)
+}
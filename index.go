@@ -1,196 +1,339 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/textproto"
+	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func handleErr(err error) {
-	if err != nil {
-		log.Fatalf("%s\n", err)
-	}
-}
-
 type parseReturn struct {
 	isControl bool
-	Data      []byte
+	pooledFrame
 }
 
 func main() {
-	runtime.SetBlockProfileRate(1)
-	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
-	}()
+	cfg, checkOnly, err := parseCommandLine(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	err = cfg.validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	if checkOnly {
+		fmt.Println("Configuration OK")
+		return
+	}
 
-	l, err := net.Listen("tcp", ":8080")
+	err = setupLogging(os.Stderr, cfg.Log.Level, cfg.Log.JSON, cfg.Log.Data)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	log.Print("Listening on port 8080")
-	defer l.Close()
+
+	if cfg.Debug.Pprof != "" {
+		runtime.SetBlockProfileRate(1)
+		go func() {
+			slog.Info("pprof listener stopped", "err", http.ListenAndServe(cfg.Debug.Pprof, nil))
+		}()
+	}
+	if cfg.Metrics.Address != "" {
+		go serveMetrics(cfg.Metrics.Address)
+	}
+
+	srv := newServer(cfg)
+	if cfg.Admin.Address != "" {
+		go serveAdmin(cfg.Admin.Address, srv)
+	}
+	serveErr := make(chan error, 1)
+	for _, listenerCfg := range cfg.Listeners {
+		settings, err := newListenerSettings(listenerCfg)
+		if err != nil {
+			slog.Error("Invalid listener", "listener", listenerCfg.String(), "err", err)
+			os.Exit(1)
+		}
+		listeners, err := listenerCfg.listen()
+		if err != nil {
+			slog.Error("Failed to listen", "listener", listenerCfg.String(), "err", err)
+			os.Exit(1)
+		}
+		for _, l := range listeners {
+			slog.Info("Listening", "network", l.Addr().Network(), "addr", l.Addr().String(), "tls", listenerCfg.TLS.CertFile != "", "proxy_protocol", listenerCfg.ProxyProtocol)
+			go func(l net.Listener) {
+				if err := srv.serve(l, settings); err != nil {
+					serveErr <- fmt.Errorf("%s: %w", l.Addr(), err)
+				}
+			}(l)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String(), "timeout", cfg.Timeouts.Shutdown)
+	case err := <-serveErr:
+		slog.Error("Listener failed", "err", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	summary := srv.shutdown(ctx)
+	slog.Info("Shutdown complete", "sessions", summary.sessions, "acknowledged", summary.acknowledged, "forced", summary.forced)
+}
+
+func (srv *server) handleConnection(c net.Conn, settings *listenerSettings) {
+	if !srv.trackConn(c) {
+		c.Close()
+		return
+	}
+	// Shut down the connection.
+	defer srv.untrackConn(c)
+	defer c.Close()
+	if !srv.limiter.acquirePreAuth() {
+		metricConnectionsRejected.With("pre_auth_limit").Inc()
+		slog.Debug("Too many unauthenticated connections, rejecting", "remote", c.RemoteAddr().String())
+		return
+	}
+	// Released early once the session is connected
+	releasePreAuth := sync.OnceFunc(srv.limiter.releasePreAuth)
+	defer releasePreAuth()
+
+	// Set the deadline first, as finding the remote address may read a PROXY protocol header
+	if srv.config.Timeouts.Handshake > 0 {
+		c.SetDeadline(time.Now().Add(srv.config.Timeouts.Handshake))
+	}
+	logger := slog.Default().With("remote", c.RemoteAddr().String())
+
+	// peerIP is the client's address if it connected directly or through a PROXY protocol balancer,
+	// rather than a reverse proxy which gives it in a header
+	var peerIP string
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok && !settings.isTrustedForwarder(tcpAddr) {
+		if reason := srv.admit(tcpAddr.IP); reason != "" {
+			metricConnectionsRejected.With(reason).Inc()
+			logger.Debug("Rejecting connection", "reason", reason)
+			return
+		}
+		ip := tcpAddr.IP.String()
+		peerIP = ip
+		if !srv.limiter.acquireIP(ip) {
+			metricConnectionsRejected.With("ip_limit").Inc()
+			logger.Debug("Too many connections from address, rejecting")
+			return
+		}
+		defer srv.limiter.releaseIP(ip)
+	}
+
+	limited := &headerLimitReader{r: c}
+	reader := bufio.NewReader(limited)
+	var header textproto.MIMEHeader
+	// Requests which aren't SSTP may go to the decoy handler, on a connection which is kept alive
 	for {
-		// Wait for a connection.
-		conn, err := l.Accept()
+		limited.limit(max(0, srv.config.Limits.MaxHeaderBytes-reader.Buffered()))
+		request, err := readHTTPRequest(reader)
+		limited.limit(-1)
+		if err == io.EOF {
+			logger.Debug("Client closed connection before HTTP request")
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			metricConnectionsRejected.With("timeout").Inc()
+			logger.Debug("Timed out reading HTTP request", "err", err)
+			return
+		}
+		if errors.Is(err, errHeaderTooLarge) {
+			metricConnectionsRejected.With("header_too_large").Inc()
+			srv.bans.recordFailure(peerIP, failureMalformed, time.Now())
+			logger.Warn("HTTP request header too large", "limit", srv.config.Limits.MaxHeaderBytes)
+			n, err := fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
+				"HTTP/1.1 431 Request Header Fields Too Large",
+				"Server: sstp-go",
+				"Connection: close",
+				"Content-Length: 35",
+				"431 Request Header Fields Too Large")
+			metricHandshakes.With("431").Inc()
+			logger.Debug("HTTP response written", "status", 431, "bytes", n, "err", err)
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			logger.Warn("Malformed HTTP", "err", err)
+			srv.bans.recordFailure(peerIP, failureMalformed, time.Now())
+			n, err := fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
+				"HTTP/1.1 400 Bad Request",
+				"Server: sstp-go",
+				"Connection: close",
+				"Content-Length: 15",
+				"400 Bad Request")
+			metricHandshakes.With("400").Inc()
+			logger.Debug("HTTP response written", "status", 400, "bytes", n, "err", err)
+			return
 		}
-		// Handle the connection in a new goroutine.
-		// The loop then returns to accepting, so that
-		// multiple connections may be served concurrently.
-		go func(c net.Conn) {
-			// Shut down the connection.
-			defer c.Close()
-
-			var method, path, version string
-			n, err := fmt.Fscan(c, &method, &path, &version)
-			handleErr(err)
-
-			if n != 3 {
-				log.Print("Malformed HTTP")
-				n, err = fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
-					"HTTP/1.1 400 Bad Request",
-					"Server: sstp-go",
-					"Connection: close",
-					"Content-Length: 15",
-					"400 Bad Request")
-				handleErr(err)
-				log.Printf("%v HTTP bytes written (400)", n)
-				return
+
+		if request.method == "SSTP_DUPLEX_POST" && request.target == srv.config.Server.Path {
+			header = request.header
+			break
+		}
+
+		if srv.decoy != nil {
+			logger.Debug("Serving decoy request", "method", request.method, "target", request.target)
+			metricHandshakes.With("decoy").Inc()
+			remote := c.RemoteAddr()
+			if settings.isTrustedForwarder(remote) {
+				if client := forwardedClient(request.header, settings.forwardedTrusted); client != nil {
+					remote = client
+				}
 			}
-			if method != "SSTP_DUPLEX_POST" {
-				log.Printf("Wrong method (%s)", method)
-				n, err = fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
-					"HTTP/1.1 405 Method Not Allowed",
-					"Allow: SSTP_DUPLEX_POST",
-					"Server: sstp-go",
-					"Connection: close",
-					"Content-Length: 22",
-					"405 Method Not Allowed")
-				handleErr(err)
-				log.Printf("%v HTTP bytes written (405)", n)
+			keepAlive, err := serveDecoy(srv.decoy, c, reader, remote, request)
+			if err != nil {
+				logger.Debug("Decoy request failed", "err", err)
+			}
+			if !keepAlive {
 				return
 			}
-			if path != "/sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/" {
-				log.Printf("Wrong path (%s)", path)
-				n, err = fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
-					"HTTP/1.1 404 File Not Found",
+			if srv.config.Timeouts.Handshake > 0 {
+				c.SetDeadline(time.Now().Add(srv.config.Timeouts.Handshake))
+			}
+			continue
+		}
+
+		if request.method != "SSTP_DUPLEX_POST" {
+			logger.Warn("Wrong method", "method", request.method)
+			n, err := fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
+				"HTTP/1.1 405 Method Not Allowed",
+				"Allow: SSTP_DUPLEX_POST",
+				"Server: sstp-go",
+				"Connection: close",
+				"Content-Length: 22",
+				"405 Method Not Allowed")
+			metricHandshakes.With("405").Inc()
+			logger.Debug("HTTP response written", "status", 405, "bytes", n, "err", err)
+			return
+		}
+		logger.Warn("Wrong path", "path", request.target)
+		n, err := fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
+			"HTTP/1.1 404 File Not Found",
+			"Server: sstp-go",
+			"Connection: close",
+			"Content-Length: 18",
+			"404 File Not Found")
+		metricHandshakes.With("404").Inc()
+		logger.Debug("HTTP response written", "status", 404, "bytes", n, "err", err)
+		return
+	}
+
+	// Trust client details given by a reverse proxy which terminates TLS in front of us
+	sessionConn := &handshakeConn{Conn: c, reader: reader, remote: c.RemoteAddr()}
+	certHashes := settings.certHashes
+	clientIP := peerIP
+	if settings.isTrustedForwarder(c.RemoteAddr()) {
+		if client := forwardedClient(header, settings.forwardedTrusted); client != nil {
+			sessionConn.remote = client
+			logger = slog.Default().With("remote", client.String(), "proxy", c.RemoteAddr().String())
+			ip := client.(*net.TCPAddr).IP
+			reason := srv.admit(ip)
+			if reason == "" && !srv.limiter.acquireIP(ip.String()) {
+				reason = "ip_limit"
+			}
+			if reason != "" {
+				metricConnectionsRejected.With(reason).Inc()
+				logger.Debug("Rejecting forwarded connection", "reason", reason)
+				n, err := fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n%s",
+					"HTTP/1.1 403 Forbidden",
 					"Server: sstp-go",
 					"Connection: close",
-					"Content-Length: 18",
-					"404 File Not Found")
-				handleErr(err)
-				log.Printf("%v HTTP bytes written (404)", n)
+					"Content-Length: 13",
+					"403 Forbidden")
+				logger.Debug("HTTP response written", "status", 403, "bytes", n, "err", err)
 				return
 			}
-
-			// digest rest of first packet
-			data := make([]byte, 2048)
-			conn.Read(data)
-			data = nil // free memory
-
-			log.Print("HTTP request received")
-
-			n, err = fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n",
-				"HTTP/1.1 200 OK",
-				"Date: Thu, 09 Nov 2006 00:51:09 GMT",
-				"Server: Microsoft-HTTPAPI/2.0",
-				"Content-Length: 18446744073709551615")
-			handleErr(err)
-			log.Printf("%v HTTP bytes written", n)
-
-			ch := make(chan parseReturn)
-			eCh := make(chan error)
-
-			packChan := make(chan []byte)
-			// TODO: shouldn't this be c, rather than conn??????
-			pppdInstance := pppdInstance{nil, nil, newUnescaper(packetHandler{conn, packChan})} // store null pointer to future pppd instance
-
-			// Start a goroutine to read from our net connection
-			go func(ch chan parseReturn, eCh chan error) {
-				for {
-					// try to read the data
-					var data [4]byte
-					// TODO: shouldn't this be c, rather than conn??????
-					n, err := conn.Read(data[:])
-					if err != nil {
-						// send an error if it's encountered
-						eCh <- err
-						return
-					}
-					if n < 4 {
-						eCh <- errors.New("Invalid packet")
-						return
-					}
-					isControl, lengthToRead, err := decodeHeader(data[:])
-					if err != nil {
-						// send an error if it's encountered
-						eCh <- err
-						return
-					}
-					newData := make([]byte, lengthToRead)
-					n, err = conn.Read(newData)
-					if err != nil {
-						// send an error if it's encountered
-						eCh <- err
-						return
-					}
-					if n != lengthToRead {
-						eCh <- errors.New("Not all of packet read")
-						return
-					}
-					ch <- parseReturn{isControl, newData}
-				}
-			}(ch, eCh)
-
-			go func(packChan chan []byte) {
-				for {
-					select {
-					case data := <-packChan: // This case means we recieved data on the connection
-						conn.Write(data)
-					}
-				}
-			}(packChan)
-
-			//ticker := time.Tick(time.Second)
-			// continuously read from the connection
-			for {
-				select {
-				case data := <-ch: // This case means we recieved data on the connection
-					// Do something with the data
-					//log.Printf("%s\n", hex.Dump(data))
-					if data.isControl {
-						header := parseControl(data.Data)
-						handleControlPacket(header, conn, &pppdInstance)
-					} else {
-						handleDataPacket(data.Data, conn, &pppdInstance)
-					}
-				case err := <-eCh: // This case means we got an error and the goroutine has finished
-					if err == io.EOF {
-						log.Print("Client disconnected")
-						if pppdInstance.commandInst != nil {
-							// kill pppd if disconnect
-							err := pppdInstance.commandInst.Process.Kill()
-							handleErr(err)
-							pppdInstance.commandInst = nil
-						}
-					} else {
-						log.Fatalf("%s\n", err)
-						// handle our error then exit for loop
-						break
-						// This will timeout on the read.
-						//case <-ticker:
-						// do nothing? this is just so we can time out if we need to.
-						// you probably don't even need to have this here unless you want
-						// do something specifically on the timeout.
-					}
-				}
+			defer srv.limiter.releaseIP(ip.String())
+			clientIP = ip.String()
+		}
+		if name := settings.config.CertHashHeader; name != "" && header.Get(name) != "" {
+			hash, err := parseCertHash(header.Get(name))
+			if err != nil {
+				logger.Warn("Ignoring invalid certificate hash from proxy", "header", name, "err", err)
+			} else {
+				certHashes = [][]byte{hash}
 			}
-		}(conn)
+		}
+	}
+
+	logger.Debug("HTTP request received")
+
+	n, err := fmt.Fprintf(c, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n",
+		"HTTP/1.1 200 OK",
+		"Date: Thu, 09 Nov 2006 00:51:09 GMT",
+		"Server: Microsoft-HTTPAPI/2.0",
+		"Content-Length: 18446744073709551615")
+	if err != nil {
+		logger.Warn("Failed to write HTTP response", "err", err)
+		return
+	}
+	logger.Debug("HTTP response written", "status", 200, "bytes", n)
+	c.SetDeadline(time.Time{})
+	if srv.config.Timeouts.FirstMessage > 0 {
+		// Cleared by the session once the first SSTP message arrives
+		c.SetReadDeadline(time.Now().Add(srv.config.Timeouts.FirstMessage))
+	}
+
+	s := newSession(srv, sessionConn)
+	s.certHashes = certHashes
+	s.releasePreAuth = releasePreAuth
+	s.clientIP = clientIP
+	if !srv.trackSession(c, s) {
+		logger.Debug("Server shutting down, closing new session")
+		return
+	}
+	s.log().Info("Session started")
+	if srv.config.Capture.All {
+		if _, err := s.startCapture(srv.config.Capture.limits()); err != nil {
+			s.log().Warn("failed to start capture", "err", err)
+		}
 	}
+
+	sessionStart := time.Now()
+	metricSessionsActive.Inc()
+	defer func() {
+		metricSessionsActive.Dec()
+		metricSessionDuration.Observe(time.Since(sessionStart).Seconds())
+	}()
+
+	s.end(s.run())
+}
+
+// handshakeConn is a connection after the HTTP handshake. Reads continue from the buffered
+// reader used for the HTTP headers, and the remote address may come from a reverse proxy.
+type handshakeConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *handshakeConn) RemoteAddr() net.Addr {
+	return c.remote
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+/* RFC 1661
+ * 6.5. Protocol-Field-Compression (PFC)
+ * 6.6. Address-and-Control-Field-Compression (ACFC)
+ * https://tools.ietf.org/html/rfc1661#section-6.5
+ */
+
+// LCP codes and options, as far as they are snooped
+const (
+	pppProtocolLCP      = 0xc021
+	lcpConfigureRequest = 1
+	lcpConfigureAck     = 2
+	lcpTerminateRequest = 5
+	lcpTerminateAck     = 6
+	lcpCodeReject       = 7
+	lcpOptionACCM       = 2
+	lcpOptionPFC        = 7
+	lcpOptionACFC       = 8
+)
+
+// pppHeader returns a frame's protocol and the packet after it, with or without the address and
+// control fields and with a compressed or full protocol field, as a receiver must accept
+func pppHeader(frame []byte) (uint16, []byte, bool) {
+	// Skip address and control fields
+	if len(frame) >= 2 && frame[0] == 0xff && frame[1] == 0x03 {
+		frame = frame[2:]
+	}
+	switch {
+	case len(frame) >= 1 && frame[0]&1 == 1:
+		return uint16(frame[0]), frame[1:], true
+	case len(frame) >= 2 && frame[1]&1 == 1:
+		return binary.BigEndian.Uint16(frame), frame[2:], true
+	}
+	return 0, nil, false
+}
+
+// lcpPacket decodes the LCP packet in a frame
+func lcpPacket(frame []byte) (*cpPacket, bool) {
+	protocol, packet, ok := pppHeader(frame)
+	if !ok || protocol != pppProtocolLCP {
+		return nil, false
+	}
+	// A malformed option ends the options, but still leaves the packet's code
+	p, _ := decodeCP(protocol, packet)
+	return p, p != nil
+}
+
+// pppLink is one direction of the link between the client and pppd. It follows the options in
+// LCP Configure-Acks travelling in that direction, which the receiving end asked for: the ACCM
+// on pppd's async link, and address/control and protocol field compression. They go back to
+// the defaults when LCP renegotiates or terminates.
+type pppLink struct {
+	accm     bool // otherwise the default map is always used
+	extra    []int
+	defaults asyncMap
+	asyncMap asyncMap
+	acfc     bool
+	pfc      bool
+}
+
+func newPPPLink(cfg pppConfig) pppLink {
+	defaults := newAsyncMap(defaultACCM, cfg.Escape)
+	return pppLink{accm: cfg.ACCM, extra: cfg.Escape, defaults: defaults, asyncMap: defaults}
+}
+
+// snoop updates the link from a frame travelling in this direction, returning the map to escape
+// the frame with: LCP Configure to Code-Reject packets always use the default
+func (l *pppLink) snoop(frame []byte) *asyncMap {
+	packet, ok := lcpPacket(frame)
+	if !ok {
+		return &l.asyncMap
+	}
+	switch packet.Code {
+	case lcpConfigureRequest, lcpTerminateRequest, lcpTerminateAck:
+		l.acfc, l.pfc = false, false
+		if l.accm {
+			l.asyncMap = l.defaults
+		}
+	case lcpConfigureAck:
+		_, l.acfc = packet.option(lcpOptionACFC)
+		_, l.pfc = packet.option(lcpOptionPFC)
+		if l.accm {
+			accm := uint32(defaultACCM)
+			if value, ok := packet.option(lcpOptionACCM); ok && len(value) == 4 {
+				accm = binary.BigEndian.Uint32(value)
+			}
+			l.asyncMap = newAsyncMap(accm, l.extra)
+		}
+	}
+	if packet.Code >= lcpConfigureRequest && packet.Code <= lcpCodeReject {
+		return &l.defaults
+	}
+	return &l.asyncMap
+}
+
+// compress rewrites a frame's header as negotiated for this direction: the address and control
+// fields are left out with ACFC, and protocols below 0x100 take one byte with PFC. LCP frames
+// always have the full header. It works in place unless the header grows beyond the frame's
+// capacity, and leaves frames without a valid protocol alone.
+func (l *pppLink) compress(frame []byte) []byte {
+	protocol, packet, ok := pppHeader(frame)
+	if !ok {
+		return frame
+	}
+	var header [4]byte
+	n := 0
+	if !l.acfc || protocol == pppProtocolLCP {
+		header[0], header[1] = 0xff, 0x03
+		n = 2
+	}
+	if l.pfc && protocol < 0x100 && protocol != pppProtocolLCP {
+		header[n] = byte(protocol)
+		n++
+	} else {
+		binary.BigEndian.PutUint16(header[n:], protocol)
+		n += 2
+	}
+	// Each header length has only one form, so the same length means the same header
+	switch old := len(frame) - len(packet); {
+	case n < old:
+		frame = frame[old-n:]
+	case n > old:
+		grow := n - old
+		frame = slices.Grow(frame, grow)[:len(frame)+grow]
+		copy(frame[grow:], frame)
+	default:
+		return frame
+	}
+	copy(frame, header[:n])
+	return frame
+}
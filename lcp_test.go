@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// lcpFrame returns an LCP packet with its address and control fields
+func lcpFrame(code byte, options ...byte) []byte {
+	length := 4 + len(options)
+	return append([]byte{0xff, 0x03, 0xc0, 0x21, code, 1, byte(length >> 8), byte(length)}, options...)
+}
+
+func TestPPPLinkSnoop(t *testing.T) {
+	cfg := defaultConfig().PPP
+	cfg.Escape = []int{0x91}
+	link := newPPPLink(cfg)
+	ipFrame := []byte{0xff, 0x03, 0x00, 0x21, 0x45}
+	if m := link.snoop(ipFrame); !m.escapes(0x01) || !m.escapes(0x91) {
+		t.Fatal("expected every control character to be escaped before negotiation")
+	}
+
+	link.snoop(lcpFrame(lcpConfigureAck, lcpOptionACCM, 6, 0, 0, 0, 0))
+	m := link.snoop(ipFrame)
+	if m.escapes(0x01) || !m.escapes(flagSequence) || !m.escapes(controlEscape) || !m.escapes(0x91) {
+		t.Fatalf("expected ACCM 0 plus the flag, escape and extra characters, got %x", *m)
+	}
+	// LCP Configure to Code-Reject packets, here a Configure-Reject, use the default map regardless
+	if m := link.snoop(lcpFrame(4)); !m.escapes(0x01) {
+		t.Fatal("expected LCP packets to escape every control character")
+	}
+	if m := link.snoop(lcpFrame(9, 0, 0, 0, 0)); m.escapes(0x01) {
+		t.Fatal("expected Echo-Requests to use the negotiated map")
+	}
+
+	link.snoop(lcpFrame(lcpConfigureAck, lcpOptionPFC, 2, lcpOptionACFC, 2))
+	if !link.acfc || !link.pfc {
+		t.Fatal("expected ACFC and PFC from the Configure-Ack")
+	}
+
+	// Renegotiating goes back to the default
+	link.snoop(lcpFrame(lcpConfigureRequest))
+	if m := link.snoop(ipFrame); !m.escapes(0x01) || link.acfc || link.pfc {
+		t.Fatal("expected a Configure-Request to reset the link")
+	}
+	// An Ack without the option also means the default
+	link.snoop(lcpFrame(lcpConfigureAck, 1, 4, 0x05, 0xdc))
+	if m := link.snoop(ipFrame); !m.escapes(0x01) {
+		t.Fatal("expected the default map without an ACCM option")
+	}
+
+	cfg.ACCM = false
+	link = newPPPLink(cfg)
+	link.snoop(lcpFrame(lcpConfigureAck, lcpOptionACCM, 6, 0, 0, 0, 0))
+	if m := link.snoop(ipFrame); !m.escapes(0x01) {
+		t.Fatal("expected the map to be ignored when accm is disabled")
+	}
+}
+
+func TestPPPHeader(t *testing.T) {
+	tests := []struct {
+		frame    []byte
+		protocol uint16
+		packet   []byte
+		ok       bool
+	}{
+		{[]byte{0xff, 0x03, 0xc0, 0x21, 1}, pppProtocolLCP, []byte{1}, true},
+		{[]byte{0xc0, 0x23, 1}, pppProtocolPAP, []byte{1}, true},
+		{[]byte{0xff, 0x03, 0x21, 0x45}, 0x21, []byte{0x45}, true},
+		{[]byte{0x21, 0x45}, 0x21, []byte{0x45}, true},
+		{[]byte{0xff, 0x03}, 0, nil, false},
+		{[]byte{0x00, 0x00, 0x45}, 0, nil, false},
+	}
+	for _, test := range tests {
+		protocol, packet, ok := pppHeader(test.frame)
+		if protocol != test.protocol || !bytes.Equal(packet, test.packet) || ok != test.ok {
+			t.Errorf("%x: got protocol %#x, packet %x, %v", test.frame, protocol, packet, ok)
+		}
+	}
+
+	// PAP and CHAP are still snooped with compressed headers
+	if name, ok := snoopUsername([]byte{0xc0, 0x23, 1, 1, 0, 9, 4, 'u', 's', 'e', 'r'}); name != "user" || !ok {
+		t.Errorf("expected the PAP peer name, got %q", name)
+	}
+}
+
+func TestPPPLinkCompress(t *testing.T) {
+	link := newPPPLink(defaultConfig().PPP)
+	full := []byte{0xff, 0x03, 0x00, 0x21, 0x45}
+	tests := []struct {
+		name      string
+		acfc, pfc bool
+		frame     []byte
+		expected  []byte
+	}{
+		{"none", false, false, full, full},
+		{"expanded", false, false, []byte{0x21, 0x45}, full},
+		{"acfc", true, false, full, []byte{0x00, 0x21, 0x45}},
+		{"pfc", false, true, []byte{0x00, 0x21, 0x45}, []byte{0xff, 0x03, 0x21, 0x45}},
+		{"both", true, true, full, []byte{0x21, 0x45}},
+		{"two byte protocol", true, true, []byte{0xff, 0x03, 0x80, 0x21, 1}, []byte{0x80, 0x21, 1}},
+		{"lcp", true, true, []byte{0xc0, 0x21, 9}, []byte{0xff, 0x03, 0xc0, 0x21, 9}},
+		{"no protocol", true, true, []byte{0xff, 0x03, 0x00, 0x00}, []byte{0xff, 0x03, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		link.acfc, link.pfc = test.acfc, test.pfc
+		frame := append(make([]byte, 0, 16), test.frame...)
+		if compressed := link.compress(frame); !bytes.Equal(compressed, test.expected) {
+			t.Errorf("%s: expected %x, got %x", test.name, test.expected, compressed)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// connLimiter limits connections which haven't completed SSTP call setup, and connections per source address
+type connLimiter struct {
+	maxPreAuth int // 0 is unlimited
+	maxPerIP   int // 0 is unlimited
+
+	mu      sync.Mutex
+	preAuth int
+	perIP   map[string]int
+}
+
+func newConnLimiter(cfg limitsConfig) *connLimiter {
+	return &connLimiter{
+		maxPreAuth: cfg.MaxPreAuth,
+		maxPerIP:   cfg.MaxPerIP,
+		perIP:      make(map[string]int),
+	}
+}
+
+// acquirePreAuth reserves a slot for a connection which hasn't yet sent CallConnected
+func (l *connLimiter) acquirePreAuth() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPreAuth > 0 && l.preAuth >= l.maxPreAuth {
+		return false
+	}
+	l.preAuth++
+	return true
+}
+
+func (l *connLimiter) releasePreAuth() {
+	l.mu.Lock()
+	l.preAuth--
+	l.mu.Unlock()
+}
+
+// acquireIP reserves a connection for a source address
+func (l *connLimiter) acquireIP(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *connLimiter) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+var errHeaderTooLarge = errors.New("HTTP request header too large")
+
+// headerLimitReader fails once more than a set number of bytes have been read, to bound the
+// memory a client can make us buffer for an HTTP request
+type headerLimitReader struct {
+	r         io.Reader
+	remaining int // -1 is unlimited
+}
+
+// limit allows n more bytes to be read, or any amount if n is negative
+func (h *headerLimitReader) limit(n int) {
+	h.remaining = n
+}
+
+func (h *headerLimitReader) Read(b []byte) (int, error) {
+	if h.remaining < 0 {
+		return h.r.Read(b)
+	}
+	if h.remaining == 0 {
+		return 0, errHeaderTooLarge
+	}
+	if len(b) > h.remaining {
+		b = b[:h.remaining]
+	}
+	n, err := h.r.Read(b)
+	h.remaining -= n
+	return n, err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderSizeLimit(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits.MaxHeaderBytes = 1024
+	addr := startTestServer(t, cfg)
+
+	conn := dialTest(t, addr)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nX-Padding: "+strings.Repeat("a", 2048)+"\r\n\r\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/1.1 431") {
+		t.Fatalf("expected 431, got %q %v", line, err)
+	}
+
+	// Requests within the limit are unaffected
+	dialSSTP(t, addr)
+}
+
+func TestHandshakeTimeouts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Timeouts.Handshake = 100 * time.Millisecond
+	cfg.Timeouts.FirstMessage = 100 * time.Millisecond
+	addr := startTestServer(t, cfg)
+
+	// Sending nothing at all
+	start := time.Now()
+	expectClosed(t, dialTest(t, addr))
+	// Sending part of the request line, then stalling
+	conn := dialTest(t, addr)
+	io.WriteString(conn, "SSTP_DUPLEX_POST ")
+	expectClosed(t, conn)
+	// Completing the HTTP handshake but sending no SSTP message
+	conn = dialSSTP(t, addr)
+	expectClosed(t, conn)
+	// Sending the header of the first SSTP message, then stalling
+	conn = dialSSTP(t, addr)
+	conn.Write([]byte{0x10, 0x01, 0x0f, 0xff})
+	expectClosed(t, conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("idle connections took %v to close", elapsed)
+	}
+
+	// The first message deadline doesn't apply to later messages
+	conn = dialSSTP(t, addr)
+	conn.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, conn, MessageTypeEchoResponse)
+	time.Sleep(200 * time.Millisecond)
+	conn.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, conn, MessageTypeEchoResponse)
+}
+
+func TestNegotiationTimeout(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	cfg.Timeouts.Negotiation = 100 * time.Millisecond
+	addr := startTestServer(t, cfg)
+
+	// A client which never sends CallConnected is aborted
+	conn := dialSSTP(t, addr)
+	conn.Write(connectRequestPacket())
+	expectControl(t, conn, MessageTypeCallConnectAck)
+	expectAbortStatus(t, conn, StatusNoError)
+	expectClosed(t, conn)
+
+	// Once the call is connected the timer no longer applies
+	conn = dialSSTP(t, addr)
+	conn.Write(connectRequestPacket())
+	conn.Write(connectedPacket(expectControl(t, conn, MessageTypeCallConnectAck), nil))
+	time.Sleep(200 * time.Millisecond)
+	conn.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, conn, MessageTypeEchoResponse)
+}
+
+func TestPerIPLimit(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits.MaxPerIP = 1
+	addr := startTestServer(t, cfg)
+
+	first := dialSSTP(t, addr)
+	expectClosed(t, dialTest(t, addr))
+
+	first.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn := dialTest(t, addr)
+		io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("address still limited after its connection closed")
+		}
+	}
+}
+
+func TestPreAuthLimit(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	cfg.Limits.MaxPreAuth = 1
+	addr := startTestServer(t, cfg)
+
+	first := dialSSTP(t, addr)
+	expectClosed(t, dialTest(t, addr))
+
+	// Once the first call is connected it no longer counts as unauthenticated
+	first.Write(connectRequestPacket())
+	ack := expectControl(t, first, MessageTypeCallConnectAck)
+	first.Write(connectedPacket(ack, nil))
+	first.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, first, MessageTypeEchoResponse)
+	dialSSTP(t, addr)
+}
+
+// Clients behind a trusted reverse proxy are limited by their forwarded address
+func TestPerIPLimitForwarded(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	cfg.Limits.MaxPerIP = 1
+	cfg.Listeners[0].ForwardedTrusted = []string{"127.0.0.1"}
+	addr := startTestServer(t, cfg)
+
+	request := func(client string) net.Conn {
+		conn := dialTest(t, addr)
+		io.WriteString(conn, "SSTP_DUPLEX_POST "+sstpPath+" HTTP/1.1\r\nHost: test\r\nX-Forwarded-For: "+client+"\r\n\r\n")
+		return conn
+	}
+	first := request("203.0.113.7")
+	readHTTPResponse(t, first)
+	status, _ := bufio.NewReader(request("203.0.113.7")).ReadString('\n')
+	if !strings.HasPrefix(status, "HTTP/1.1 403") {
+		t.Fatalf("expected a second connection from the address to be refused, got %q", status)
+	}
+	// Another client behind the same proxy isn't affected
+	readHTTPResponse(t, request("203.0.113.8"))
+
+	first.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		status, _ := bufio.NewReader(request("203.0.113.7")).ReadString('\n')
+		if strings.HasPrefix(status, "HTTP/1.1 200") {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("address still limited after its connection closed")
+		}
+	}
+}
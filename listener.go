@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Kinds of listener in listener.network
+const (
+	networkUnix    = "unix"
+	networkSystemd = "systemd"
+)
+
+// listenerSettings are the parts of a listener's configuration used while handling its connections
+type listenerSettings struct {
+	config listenerConfig
+	// certHashes are the certificate hashes clients should send in their crypto binding
+	certHashes [][]byte
+	// forwardedTrusted are reverse proxies whose Forwarded and X-Forwarded-For headers are used
+	forwardedTrusted []*net.IPNet
+}
+
+func newListenerSettings(cfg listenerConfig) (*listenerSettings, error) {
+	certHashes, err := listenerCertHashes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	forwardedTrusted, err := parseCIDRs(cfg.ForwardedTrusted)
+	if err != nil {
+		return nil, err
+	}
+	return &listenerSettings{cfg, certHashes, forwardedTrusted}, nil
+}
+
+// isTrustedForwarder reports whether forwarding headers from the connection's peer should be trusted
+func (ls *listenerSettings) isTrustedForwarder(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(ls.forwardedTrusted, tcpAddr.IP)
+}
+
+// String describes the listener for logs
+func (l listenerConfig) String() string {
+	if l.Network == networkSystemd {
+		if l.Name == "" {
+			return "systemd"
+		}
+		return "systemd:" + l.Name
+	}
+	return l.network() + ":" + l.Address
+}
+
+func (l listenerConfig) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+// listen opens the configured sockets, wrapping them in TLS if a certificate is configured.
+// A systemd listener may return several sockets; the others return one.
+func (l listenerConfig) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	switch l.network() {
+	case "tcp", "tcp4", "tcp6":
+		listener, err := net.Listen(l.network(), l.Address)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	case networkUnix:
+		listener, err := listenUnix(l.Address, l.SocketMode)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	case networkSystemd:
+		var err error
+		listeners, err = systemdListeners(l.Name)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown network %q", l.Network)
+	}
+
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	if l.ProxyProtocol {
+		// The PROXY protocol header comes before the TLS handshake
+		trusted, err := parseCIDRs(l.ProxyTrusted)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		for i := range listeners {
+			listeners[i] = newProxyListener(listeners[i], trusted)
+		}
+	}
+	if l.TLS.CertFile == "" {
+		return listeners, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	for i := range listeners {
+		listeners[i] = tls.NewListener(listeners[i], tlsConfig)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket left by a previous run
+func listenUnix(path string, mode uint32) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial(networkUnix, path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen(networkUnix, path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+/* systemd socket activation
+ * https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+ */
+
+type systemdSocket struct {
+	name     string
+	listener net.Listener
+	claimed  bool
+}
+
+var (
+	systemdOnce    sync.Once
+	systemdSockets []*systemdSocket
+	systemdErr     error
+)
+
+// systemdListeners returns the sockets passed by systemd with the given FileDescriptorName,
+// or all remaining sockets if name is empty. Each socket is only returned once.
+func systemdListeners(name string) ([]net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdSockets, systemdErr = inheritSystemdSockets()
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+	var listeners []net.Listener
+	for _, socket := range systemdSockets {
+		if !socket.claimed && (name == "" || socket.name == name) {
+			socket.claimed = true
+			listeners = append(listeners, socket.listener)
+		}
+	}
+	if len(listeners) == 0 {
+		if name == "" {
+			return nil, errors.New("no unused sockets passed by systemd")
+		}
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenerArrayConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sstp-go.toml")
+	os.WriteFile(path, []byte(`
+[[listener]]
+address = "[::]:443"
+tls.cert_file = "server.crt"
+tls.key_file = "server.key"
+[[listener]]
+network = "unix"
+address = "/run/sstp-go.sock"
+socket_mode = 0o660
+proxy_protocol = true
+[[listener]]
+network = "systemd"
+name = "sstp"
+`), 0644)
+	cfg, _, err := parseCommandLine([]string{"-config", path}, func(string) string { return "" }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listeners) != 3 {
+		t.Fatalf("expected 3 listeners, got %+v", cfg.Listeners)
+	}
+	if cfg.Listeners[0].Address != "[::]:443" || cfg.Listeners[0].TLS.CertFile != "server.crt" {
+		t.Errorf("unexpected first listener %+v", cfg.Listeners[0])
+	}
+	if l := cfg.Listeners[1]; l.Network != "unix" || l.SocketMode != 0o660 || !l.ProxyProtocol || l.TLS.CertFile != "" {
+		t.Errorf("unexpected unix listener %+v", l)
+	}
+	if l := cfg.Listeners[2]; l.Network != "systemd" || l.Name != "sstp" {
+		t.Errorf("unexpected systemd listener %+v", l)
+	}
+
+	// Flags and the environment configure the last listener
+	cfg, _, err = parseCommandLine([]string{"-config", path, "-listen-network", "tcp6", "-listen", "[::1]:8443"}, func(string) string { return "" }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := cfg.Listeners[2]; l.Network != "tcp6" || l.Address != "[::1]:8443" {
+		t.Errorf("flags not applied to last listener: %+v", l)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sstp.sock")
+	// A stale socket from a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	cfg := defaultConfig()
+	cfg.Listeners = []listenerConfig{{Network: "unix", Address: path, SocketMode: 0o600}}
+	listeners, err := cfg.Listeners[0].listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listeners[0].Close() })
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode not set: %v %v", info.Mode(), err)
+	}
+	if _, err := cfg.Listeners[0].listen(); err == nil {
+		t.Fatal("listening on a socket in use succeeded")
+	}
+
+	settings, _ := newListenerSettings(cfg.Listeners[0])
+	go newServer(cfg).serve(listeners[0], settings)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	handshakeSSTP(t, conn)
+	conn.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, conn, MessageTypeEchoResponse)
+}
+
+func TestSystemdListener(t *testing.T) {
+	if address := os.Getenv("SSTP_TEST_SYSTEMD_ADDRESS"); address != "" {
+		// Running as the activated child
+		listeners, err := systemdListeners("sstp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listeners) != 1 || listeners[0].Addr().String() != address {
+			t.Fatalf("expected the listener on %s, got %v", address, listeners)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Fatal("LISTEN_FDS left for child processes")
+		}
+		if _, err := systemdListeners(""); err == nil {
+			t.Fatal("socket returned twice")
+		}
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// LISTEN_PID must be the child's own PID, which the shell knows before exec
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$@"`, "sh", os.Args[0], "-test.run=^TestSystemdListener$")
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=sstp", "SSTP_TEST_SYSTEMD_ADDRESS="+l.Addr().String())
+	cmd.ExtraFiles = []*os.File{file}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("activated child failed: %v\n%s", err, output)
+	}
+}
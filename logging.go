@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// logDataFrames enables hex dumps of SSTP data packets when logging at debug level
+var logDataFrames bool
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// setupLogging installs the default slog logger, writing text or JSON lines to w
+func setupLogging(w io.Writer, level string, json bool, dumpData bool) error {
+	slogLevel, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: slogLevel}
+
+	var handler slog.Handler
+	if json {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	slog.SetDefault(slog.New(handler))
+	logDataFrames = dumpData
+	return nil
+}
+
+// hexDump is a lazily evaluated hex.Dump, so packets are only formatted when debug logging is enabled
+type hexDump []byte
+
+func (h hexDump) LogValue() slog.Value {
+	return slog.StringValue(hex.Dump(h))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/* Prometheus text exposition format, version 0.0.4
+ * https://prometheus.io/docs/instrumenting/exposition_formats/
+ */
+
+type counter struct {
+	value uint64
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) Add(n int) {
+	atomic.AddUint64(&c.value, uint64(n))
+}
+
+type gauge struct {
+	value int64
+}
+
+func (g *gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+// counterVec is a set of counters partitioned by label values
+type counterVec struct {
+	labels []string
+	mu     sync.Mutex
+	values map[string]*counter
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: make(map[string]*counter)}
+}
+
+// With returns the counter for the given label values, in the order the labels were declared
+func (v *counterVec) With(labelValues ...string) *counter {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.values[key]
+	if !ok {
+		c = &counter{}
+		v.values[key] = c
+	}
+	return c
+}
+
+type histogram struct {
+	buckets []float64 // upper bounds, ascending, without +Inf
+	mu      sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+type metricDesc struct {
+	name       string
+	help       string
+	metricType string
+	metric     interface{}
+}
+
+type metricRegistry struct {
+	metrics []metricDesc
+}
+
+func (r *metricRegistry) register(name string, help string, metric interface{}) {
+	var metricType string
+	switch metric.(type) {
+	case *counter, *counterVec:
+		metricType = "counter"
+	case *gauge:
+		metricType = "gauge"
+	case *histogram:
+		metricType = "histogram"
+	default:
+		panic(fmt.Sprintf("unknown metric type %T", metric))
+	}
+	r.metrics = append(r.metrics, metricDesc{name, help, metricType, metric})
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *metricRegistry) writeTo(w io.Writer) {
+	for _, desc := range r.metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", desc.name, desc.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", desc.name, desc.metricType)
+
+		switch m := desc.metric.(type) {
+		case *counter:
+			fmt.Fprintf(w, "%s %d\n", desc.name, atomic.LoadUint64(&m.value))
+		case *gauge:
+			fmt.Fprintf(w, "%s %d\n", desc.name, atomic.LoadInt64(&m.value))
+		case *counterVec:
+			m.mu.Lock()
+			keys := make([]string, 0, len(m.values))
+			for key := range m.values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				labels := formatLabels(m.labels, strings.Split(key, "\xff"))
+				fmt.Fprintf(w, "%s%s %d\n", desc.name, labels, atomic.LoadUint64(&m.values[key].value))
+			}
+			m.mu.Unlock()
+		case *histogram:
+			m.mu.Lock()
+			for i, bound := range m.buckets {
+				fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", desc.name, formatFloat(bound), m.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", desc.name, m.count)
+			fmt.Fprintf(w, "%s_sum %s\n", desc.name, formatFloat(m.sum))
+			fmt.Fprintf(w, "%s_count %d\n", desc.name, m.count)
+			m.mu.Unlock()
+		}
+	}
+}
+
+func (r *metricRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.writeTo(w)
+}
+
+var (
+	metricHandshakes          = newCounterVec("outcome")
+	metricSessionsActive      = &gauge{}
+	metricControlMessages     = newCounterVec("type", "direction")
+	metricDataBytes           = newCounterVec("direction")
+	metricDataPackets         = newCounterVec("direction")
+	metricPPPDSpawnFailures   = &counter{}
+	metricPPPDExits           = newCounterVec("reason")
+	metricFCSErrors           = &counter{}
+	metricMalformedFrames     = newCounterVec("reason")
+	metricProxyProtocolErrors = &counter{}
+	metricConnectionsRejected = newCounterVec("reason")
+	metricBans                = newCounterVec("reason")
+	metricQuotaDisconnects    = &counter{}
+	metricDroppedPackets      = newCounterVec("direction")
+	metricAuthMethods         = newCounterVec("method")
+	metricOversizeFrames      = newCounterVec("direction")
+	metricNegotiatedMRU       = newHistogram(576, 1280, 1400, 1450, 1500, 4096)
+	metricSessionDuration     = newHistogram(1, 10, 60, 300, 900, 3600, 4*3600, 12*3600, 24*3600)
+	metrics                   = &metricRegistry{}
+)
+
+func init() {
+	// Pre-populate handshake outcomes so they are exported before the first connection
+	for _, outcome := range []string{"400", "404", "405", "ack", "nak", "abort", "decoy", "431"} {
+		metricHandshakes.With(outcome)
+	}
+	for _, reason := range []string{"pre_auth_limit", "ip_limit", "header_too_large", "timeout", "banned", "rate_limit"} {
+		metricConnectionsRejected.With(reason)
+	}
+	for _, reason := range []frameError{errFrameAborted, errRuntFrame, errFrameTooLong} {
+		metricMalformedFrames.With(string(reason))
+	}
+	for _, reason := range append([]string{"killed", "unknown"}, pppdExitReasons...) {
+		metricPPPDExits.With(reason)
+	}
+	for _, method := range []string{"pap", "chap_md5", "mschap", "mschapv2", "eap", "other"} {
+		metricAuthMethods.With(method)
+	}
+	for _, direction := range []string{"rx", "tx"} {
+		metricDataBytes.With(direction)
+		metricDataPackets.With(direction)
+		metricDroppedPackets.With(direction)
+		metricOversizeFrames.With(direction)
+	}
+
+	metrics.register("sstp_handshakes_total", "SSTP handshakes by outcome.", metricHandshakes)
+	metrics.register("sstp_sessions_active", "Number of SSTP sessions currently established.", metricSessionsActive)
+	metrics.register("sstp_control_messages_total", "SSTP control messages by message type and direction.", metricControlMessages)
+	metrics.register("sstp_data_bytes_total", "PPP payload bytes carried in SSTP data packets.", metricDataBytes)
+	metrics.register("sstp_data_packets_total", "SSTP data packets.", metricDataPackets)
+	metrics.register("sstp_pppd_spawn_failures_total", "Number of times pppd could not be started.", metricPPPDSpawnFailures)
+	metrics.register("sstp_pppd_exits_total", "pppd exits, by the reason its exit status gives.", metricPPPDExits)
+	metrics.register("sstp_fcs_errors_total", "PPP frames from pppd dropped for a bad FCS.", metricFCSErrors)
+	metrics.register("sstp_malformed_frames_total", "Malformed PPP frames from pppd dropped, by reason.", metricMalformedFrames)
+	metrics.register("sstp_proxy_protocol_errors_total", "Connections from trusted proxies with a missing or invalid PROXY protocol header.", metricProxyProtocolErrors)
+	metrics.register("sstp_connections_rejected_total", "Connections closed before an SSTP session was established, by reason.", metricConnectionsRejected)
+	metrics.register("sstp_bans_total", "Addresses banned automatically, by the failure which triggered the ban.", metricBans)
+	metrics.register("sstp_quota_disconnects_total", "Sessions disconnected for exceeding a byte quota.", metricQuotaDisconnects)
+	metrics.register("sstp_dropped_packets_total", "Data packets dropped because a session's queue was full.", metricDroppedPackets)
+	metrics.register("sstp_oversize_frames_total", "PPP frames dropped for exceeding ppp.mru, by direction.", metricOversizeFrames)
+	metrics.register("sstp_auth_methods_total", "Authentication methods clients agreed to in LCP, by method.", metricAuthMethods)
+	metrics.register("sstp_negotiated_mru_bytes", "MRUs clients negotiated with pppd in LCP.", metricNegotiatedMRU)
+	metrics.register("sstp_session_duration_seconds", "Duration of SSTP sessions.", metricSessionDuration)
+}
+
+// serveMetrics exposes the metrics registry on addr, separately from the pprof listener
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	slog.Info("Serving metrics", "addr", addr)
+	slog.Error("metrics listener stopped", "err", http.ListenAndServe(addr, mux))
+}
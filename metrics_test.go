@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	registry := &metricRegistry{}
+	requests := &counter{}
+	requests.Add(3)
+	registry.register("test_requests_total", "Requests.", requests)
+	active := &gauge{}
+	active.Inc()
+	registry.register("test_active", "Active things.", active)
+	reasons := newCounterVec("reason", "direction")
+	reasons.With(`quote " backslash \ newline`+"\n", "rx").Inc()
+	registry.register("test_reasons_total", "Reasons, by reason.", reasons)
+	sizes := newHistogram(1, 10)
+	sizes.Observe(5)
+	registry.register("test_sizes", "Sizes.", sizes)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total 3
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active 1
+# HELP test_reasons_total Reasons, by reason.
+# TYPE test_reasons_total counter
+test_reasons_total{reason="quote \" backslash \\ newline\n",direction="rx"} 1
+# HELP test_sizes Sizes.
+# TYPE test_sizes histogram
+test_sizes_bucket{le="1"} 0
+test_sizes_bucket{le="10"} 1
+test_sizes_bucket{le="+Inf"} 1
+test_sizes_sum 5
+test_sizes_count 1
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, body)
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	// Control messages of types the client makes up share one label value
+	if label := MessageType(200).metricLabel(); label != "unknown" {
+		t.Errorf("expected an unknown message type to be labelled unknown, got %s", label)
+	}
+	metricControlMessages.With(MessageType(200).metricLabel(), "rx").Inc()
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	response, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	for _, desc := range metrics.metrics {
+		for _, line := range []string{"# HELP " + desc.name + " ", "# TYPE " + desc.name + " " + desc.metricType + "\n"} {
+			if !strings.Contains(string(body), line) {
+				t.Errorf("expected %q in the scrape", line)
+			}
+		}
+	}
+	if !strings.Contains(string(body), `sstp_control_messages_total{type="unknown",direction="rx"}`) {
+		t.Error("expected unknown control messages under one label")
+	}
+	if !strings.Contains(string(body), `sstp_handshakes_total{outcome="nak"}`) {
+		t.Error("expected the nak handshake outcome to be exported")
+	}
+}
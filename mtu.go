@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+/* RFC 1661 6.1. Maximum-Receive-Unit (MRU)
+ * https://tools.ietf.org/html/rfc1661#section-6.1
+ * RFC 6691 TCP Options and Maximum Segment Size (MSS)
+ * https://tools.ietf.org/html/rfc6691
+ * RFC 1624 Computation of the Internet Checksum via Incremental Update
+ * https://tools.ietf.org/html/rfc1624
+ */
+
+const (
+	pppHeaderLength = 4 // address and control fields and a full protocol field
+	minMRU          = 128
+	maxMRU          = maxFrameSize - pppHeaderLength
+	defaultMRU      = 1500 // RFC 1661's, which pppd negotiates unless its options say otherwise
+
+	tcpProtocol  = 6
+	tcpFlagSYN   = 0x02
+	tcpOptionEnd = 0
+	tcpOptionNOP = 1
+	tcpOptionMSS = 2
+)
+
+// frameMRU returns the longest information field let through: ppp.mru, or whatever an SSTP packet
+// carries when pppd's options decide the MRU
+func (c pppConfig) frameMRU() int {
+	if c.MRU == 0 {
+		return maxMRU
+	}
+	return c.MRU
+}
+
+// clampMRU returns the MRU TCP MSS options are clamped to: ppp.mru, or the default MRU
+func (c pppConfig) clampMRU() int {
+	if c.MRU == 0 {
+		return defaultMRU
+	}
+	return c.MRU
+}
+
+// oversize reports whether a frame's information field is longer than the MRU, counting and
+// logging it. Frames without a valid protocol are left to pppd and the client to reject.
+func (s *session) oversize(direction string, frame []byte) bool {
+	mru := s.server.config.PPP.frameMRU()
+	_, packet, ok := pppHeader(frame)
+	if !ok || len(packet) <= mru {
+		return false
+	}
+	metricOversizeFrames.With(direction).Inc()
+	s.log().Debug("Dropped frame over the MRU", "direction", direction, "length", len(packet), "mru", mru)
+	return true
+}
+
+// clampMSS lowers the MSS option of a TCP SYN in an IPv4 or IPv6 frame so that segments fit in
+// mru, updating the TCP checksum, for clients which don't discover the path MTU. IPv4 fragments
+// and packets with extension headers are left alone.
+func clampMSS(frame []byte, mru int) {
+	protocol, packet, ok := pppHeader(frame)
+	if !ok {
+		return
+	}
+	var segment []byte
+	var maxMSS int
+	switch protocol {
+	case pppProtocolIPv4:
+		if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != tcpProtocol || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return
+		}
+		headerLength := int(packet[0]&0x0f) * 4
+		if headerLength < 20 || headerLength > len(packet) {
+			return
+		}
+		segment, maxMSS = packet[headerLength:], mru-40
+	case pppProtocolIPv6:
+		if len(packet) < 40 || packet[0]>>4 != 6 || packet[6] != tcpProtocol {
+			return
+		}
+		segment, maxMSS = packet[40:], mru-60
+	default:
+		return
+	}
+	if len(segment) < 20 || segment[13]&tcpFlagSYN == 0 {
+		return
+	}
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(segment) {
+		return
+	}
+	for i := 20; i < dataOffset; {
+		switch segment[i] {
+		case tcpOptionEnd:
+			return
+		case tcpOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= dataOffset || segment[i+1] < 2 || i+int(segment[i+1]) > dataOffset {
+			return
+		}
+		if segment[i] == tcpOptionMSS && segment[i+1] == 4 {
+			mss := binary.BigEndian.Uint16(segment[i+2:])
+			if int(mss) <= maxMSS {
+				return
+			}
+			binary.BigEndian.PutUint16(segment[i+2:], uint16(maxMSS))
+			old, new := mss, uint16(maxMSS)
+			// The checksum sums 16-bit words, which the MSS straddles at an odd offset
+			if i%2 == 1 {
+				old, new = bits.ReverseBytes16(old), bits.ReverseBytes16(new)
+			}
+			checksum := binary.BigEndian.Uint16(segment[16:18])
+			binary.BigEndian.PutUint16(segment[16:18], updateChecksum(checksum, old, new))
+			return
+		}
+		i += int(segment[i+1])
+	}
+}
+
+// updateChecksum returns an Internet checksum after a 16-bit word changed from old to new,
+// following RFC 1624's HC' = ~(~HC + ~m + m')
+func updateChecksum(checksum, old, new uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^old) + uint32(new)
+	sum = sum&0xffff + sum>>16
+	sum = sum&0xffff + sum>>16
+	return ^uint16(sum)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tcpFrame returns a PPP frame holding a TCP segment with the given flags and options, and a
+// valid checksum
+func tcpFrame(ipv6 bool, flags byte, options ...byte) []byte {
+	segment := []byte{0x1f, 0x90, 0x01, 0xbb, 0, 0, 0, 1, 0, 0, 0, 0, byte(20+len(options)) / 4 << 4, flags, 0xff, 0xff, 0, 0, 0, 0}
+	segment = append(segment, options...)
+	var frame, pseudo []byte
+	if ipv6 {
+		header := []byte{0x60, 0, 0, 0, 0, byte(len(segment)), tcpProtocol, 64}
+		header = append(append(header, net.ParseIP("2001:db8::2")...), net.ParseIP("2001:db8::1")...)
+		frame = append([]byte{0xff, 0x03, 0x00, 0x57}, header...)
+		pseudo = append(slices.Clone(header[8:40]), 0, 0, 0, byte(len(segment)), 0, 0, 0, tcpProtocol)
+	} else {
+		header := []byte{0x45, 0, 0, byte(20 + len(segment)), 0, 0, 0x40, 0, 64, tcpProtocol, 0, 0, 10, 0, 0, 2, 192, 0, 2, 1}
+		frame = append([]byte{0xff, 0x03, 0x00, 0x21}, header...)
+		pseudo = append(slices.Clone(header[12:20]), 0, tcpProtocol, 0, byte(len(segment)))
+	}
+	binary.BigEndian.PutUint16(segment[16:], ^internetSum(append(pseudo, segment...)))
+	return append(frame, segment...)
+}
+
+// internetSum returns the ones' complement sum of data's 16-bit words
+func internetSum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		word := uint32(data[i]) << 8
+		if i+1 < len(data) {
+			word |= uint32(data[i+1])
+		}
+		sum += word
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+func TestClampMSS(t *testing.T) {
+	mss1460 := []byte{tcpOptionMSS, 4, 0x05, 0xb4}
+	tests := []struct {
+		name    string
+		ipv6    bool
+		flags   byte
+		options []byte
+		clamped []byte // nil if the frame is left alone
+	}{
+		{"ipv4 syn", false, tcpFlagSYN, mss1460, []byte{tcpOptionMSS, 4, 0x05, 0x50}},
+		// The MSS straddles the checksum's 16-bit words after a NOP
+		{"ipv4 syn-ack after a nop", false, tcpFlagSYN | 0x10, []byte{tcpOptionNOP, tcpOptionMSS, 4, 0x05, 0xb4, 0, 0, 0},
+			[]byte{tcpOptionNOP, tcpOptionMSS, 4, 0x05, 0x50, 0, 0, 0}},
+		{"ipv6 syn", true, tcpFlagSYN, mss1460, []byte{tcpOptionMSS, 4, 0x05, 0x3c}},
+		{"small mss", false, tcpFlagSYN, []byte{tcpOptionMSS, 4, 0x02, 0x18}, nil},
+		{"not a syn", false, 0x10, mss1460, nil},
+		{"truncated option", false, tcpFlagSYN, []byte{tcpOptionNOP, tcpOptionNOP, tcpOptionNOP, tcpOptionMSS}, nil},
+	}
+	for _, test := range tests {
+		frame := tcpFrame(test.ipv6, test.flags, test.options...)
+		expected := slices.Clone(frame)
+		if test.clamped != nil {
+			// The checksum is computed from scratch, to check the incremental update
+			expected = tcpFrame(test.ipv6, test.flags, test.clamped...)
+		}
+		clampMSS(frame, 1400)
+		if !bytes.Equal(frame, expected) {
+			t.Errorf("%s: expected %x, got %x", test.name, expected, frame)
+		}
+	}
+}
+
+func TestOversizeFrames(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PPP.MRU = 1400
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+	s := srv.sessions()[0]
+	tx := atomic.LoadUint64(&metricOversizeFrames.With("tx").value)
+	rx := atomic.LoadUint64(&metricOversizeFrames.With("rx").value)
+	client.Write(controlPacket(MessageTypeEchoRequest))
+	expectControl(t, client, MessageTypeEchoResponse)
+
+	// The information field counts towards the MRU, not the PPP header
+	header := []byte{0xff, 0x03, 0x00, 0x21}
+	packetHandler{s}.Write(append(header, make([]byte, 1401)...))
+	frame := append(header, make([]byte, 1400)...)
+	packetHandler{s}.Write(frame)
+	if isControl, data := readTestPacket(t, client); isControl || !bytes.Equal(data, frame) {
+		t.Fatalf("expected the frame within the MRU, got %d bytes", len(data))
+	}
+	if atomic.LoadUint64(&metricOversizeFrames.With("tx").value) != tx+1 {
+		t.Error("expected the oversize frame from pppd to be counted")
+	}
+
+	buf := getFrameBuffer()
+	if err := handleDataPacket(pooledFrame{buf, append(buf[:0], append(header, make([]byte, 1401)...)...)}, s); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&metricOversizeFrames.With("rx").value) != rx+1 {
+		t.Error("expected the oversize frame from the client to be counted")
+	}
+
+	args := strings.Join(pppdArgs(cfg.PPP, "", s.conn.RemoteAddr(), s.id, ""), " ")
+	if !strings.Contains(args, "mru 1400 mtu 1400") {
+		t.Errorf("expected pppd to be limited to the MRU, got %q", args)
+	}
+	// Without an MRU, the options file's is left alone
+	args = strings.Join(pppdArgs(defaultConfig().PPP, "", s.conn.RemoteAddr(), s.id, ""), " ")
+	if strings.Contains(args, "mru") || strings.Contains(args, "mtu") {
+		t.Errorf("expected no MRU or MTU for pppd, got %q", args)
+	}
+	if mru := defaultConfig().PPP.frameMRU(); mru != maxMRU {
+		t.Errorf("expected frames up to what an SSTP packet carries, got an MRU of %d", mru)
+	}
+}
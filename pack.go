@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/binary"
-	"log"
 	"net"
 )
 
@@ -36,40 +35,60 @@ func packControlHeader(header sstpControlHeader, outputBytes []byte) {
 	}
 }
 
-func sendConnectionAckPacket(conn net.Conn) {
-	// Fake attribute, we don't actually implement crypto binding
+func sendConnectionAckPacket(s *session) error {
 	header := sstpHeader{1, 0, true, 48}
 	attributes := make([]sstpAttribute, 1)
-	data := []byte{0, 0, 0, 3} // 3 means, supports SHA1 and SHA256
+	data := make([]byte, 4, 4+len(s.nonce))
+	data[3] = certHashProtocolSHA1 | certHashProtocolSHA256 // supports SHA1 and SHA256
+	data = append(data, s.nonce[:]...)
 	attributes[0] = sstpAttribute{0, AttributeIDCryptoBindingReq, 40, data}
 	controlHeader := sstpControlHeader{header, MessageTypeCallConnectAck, uint16(len(attributes)), attributes}
 
-	log.Printf("write: %v\n", controlHeader)
+	s.log().Debug("write control packet", "type", controlHeader.MessageType, "attributes", len(attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "tx").Inc()
 	outputBytes := make([]byte, 48)
 	packControlHeader(controlHeader, outputBytes)
-	conn.Write(outputBytes)
+	s.log().Debug("write control packet", "dump", hexDump(outputBytes))
+	return s.writeControl(outputBytes)
 }
 
-func sendDisconnectAckPacket(conn net.Conn) {
+func sendDisconnectAckPacket(s *session) error {
 	header := sstpHeader{1, 0, true, 8}
 	attributes := make([]sstpAttribute, 0)
 	controlHeader := sstpControlHeader{header, MessageTypeCallDisconnectAck, 0, attributes}
 
-	log.Printf("write: %v\n", controlHeader)
+	s.log().Debug("write control packet", "type", controlHeader.MessageType, "attributes", len(attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "tx").Inc()
 	outputBytes := make([]byte, 8)
 	packControlHeader(controlHeader, outputBytes)
-	conn.Write(outputBytes)
+	s.log().Debug("write control packet", "dump", hexDump(outputBytes))
+	return s.writeControl(outputBytes)
 }
 
-func sendEchoResponsePacket(conn net.Conn) {
+func sendCallDisconnectPacket(s *session) error {
+	header := sstpHeader{1, 0, true, 8}
+	attributes := make([]sstpAttribute, 0)
+	controlHeader := sstpControlHeader{header, MessageTypeCallDisconnect, 0, attributes}
+
+	s.log().Debug("write control packet", "type", controlHeader.MessageType, "attributes", len(attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "tx").Inc()
+	outputBytes := make([]byte, 8)
+	packControlHeader(controlHeader, outputBytes)
+	s.log().Debug("write control packet", "dump", hexDump(outputBytes))
+	return s.writeControl(outputBytes)
+}
+
+func sendEchoResponsePacket(s *session) error {
 	header := sstpHeader{1, 0, true, 8}
 	attributes := make([]sstpAttribute, 0)
 	controlHeader := sstpControlHeader{header, MessageTypeEchoResponse, 0, attributes}
 
-	log.Printf("write: %v\n", controlHeader)
+	s.log().Debug("write control packet", "type", controlHeader.MessageType, "attributes", len(attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "tx").Inc()
 	outputBytes := make([]byte, 8)
 	packControlHeader(controlHeader, outputBytes)
-	conn.Write(outputBytes)
+	s.log().Debug("write control packet", "dump", hexDump(outputBytes))
+	return s.writeControl(outputBytes)
 }
 
 func packDataHeader(header sstpDataHeader, outputBytes []byte) {
@@ -89,10 +108,62 @@ func sendDataPacket(inputBytes []byte, conn net.Conn) {
 }
 
 func packDataPacketFast(inputBytes []byte) []byte {
-	packetBytes := make([]byte, len(inputBytes)+4)
-	packetBytes[0] = 0x10
+	return appendDataPacket(make([]byte, 0, sstpHeaderLength+len(inputBytes)), inputBytes)
+}
+
+// appendDataPacket appends an SSTP data packet carrying a PPP frame to outputBytes, writing
+// the header straight in front of the frame
+func appendDataPacket(outputBytes []byte, inputBytes []byte) []byte {
 	// byte 1 is 0 - data packet
-	binary.BigEndian.PutUint16(packetBytes[2:4], uint16(len(packetBytes)))
-	copy(packetBytes[4:], inputBytes)
-	return packetBytes
+	outputBytes = append(outputBytes, 0x10, 0, 0, 0)
+	binary.BigEndian.PutUint16(outputBytes[len(outputBytes)-2:], uint16(sstpHeaderLength+len(inputBytes)))
+	return append(outputBytes, inputBytes...)
+}
+
+func packStatusInfo(attributeID AttributeID, status StatusCode) sstpAttribute {
+	data := make([]byte, 8)
+	// 3 Reserved bytes
+	data[3] = uint8(attributeID)
+	binary.BigEndian.PutUint32(data[4:8], uint32(status))
+	return sstpAttribute{0, AttributeIDStatusInfo, uint16(4 + len(data)), data}
+}
+
+// sendConnectNakPacket refuses a CallConnectRequest, with a StatusInfo attribute holding the
+// value the server supports instead
+func sendConnectNakPacket(s *session, attributeID AttributeID, status StatusCode, supported []byte) error {
+	attribute := packStatusInfo(attributeID, status)
+	attribute.Data = append(attribute.Data, supported...)
+	attribute.Length += uint16(len(supported))
+	attributes := []sstpAttribute{attribute}
+	length := 8 + int(attribute.Length)
+	header := sstpHeader{1, 0, true, uint16(length)}
+	controlHeader := sstpControlHeader{header, MessageTypeCallConnectNak, uint16(len(attributes)), attributes}
+
+	s.log().Debug("write control packet", "type", controlHeader.MessageType, "attributes", len(attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "tx").Inc()
+	outputBytes := make([]byte, length)
+	packControlHeader(controlHeader, outputBytes)
+	s.log().Debug("write control packet", "dump", hexDump(outputBytes))
+	return s.writeControl(outputBytes)
+}
+
+// sendCallAbortPacket tells the client the session is being torn down, with a StatusInfo attribute
+// unless status is StatusNoError
+func sendCallAbortPacket(s *session, status StatusCode, attributeID AttributeID) error {
+	attributes := make([]sstpAttribute, 0, 1)
+	length := 8
+	if status != StatusNoError {
+		attribute := packStatusInfo(attributeID, status)
+		attributes = append(attributes, attribute)
+		length += int(attribute.Length)
+	}
+	header := sstpHeader{1, 0, true, uint16(length)}
+	controlHeader := sstpControlHeader{header, MessageTypeCallAbort, uint16(len(attributes)), attributes}
+
+	s.log().Debug("write control packet", "type", controlHeader.MessageType, "attributes", len(attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "tx").Inc()
+	outputBytes := make([]byte, length)
+	packControlHeader(controlHeader, outputBytes)
+	s.log().Debug("write control packet", "dump", hexDump(outputBytes))
+	return s.writeControl(outputBytes)
 }
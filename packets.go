@@ -27,6 +27,15 @@ const (
 	MessageTypeEchoResponse       = 9
 )
 
+// metricLabel names the message type for metrics. Types a client makes up share one label, so
+// they can't add label values without bound.
+func (k MessageType) metricLabel() string {
+	if k < MessageTypeCallConnectRequest || k > MessageTypeEchoResponse {
+		return "unknown"
+	}
+	return k.String()
+}
+
 func (k MessageType) String() string {
 	switch k {
 	case MessageTypeCallConnectRequest:
@@ -85,6 +94,13 @@ func (k AttributeID) String() string {
 	}
 }
 
+// Encapsulated protocols a CallConnectRequest may ask for; PPP is the only one
+const encapsulatedProtocolPPP = 1
+
+// maxConnectNaks is how many CallConnectRequests are refused with CallConnectNak before the call
+// is aborted, MS-SSTP's maximum retry count
+const maxConnectNaks = 3
+
 type sstpAttribute struct {
 	Reserved    byte
 	AttributeID AttributeID
@@ -96,3 +112,53 @@ type sstpDataHeader struct {
 	sstpHeader
 	Data []byte
 }
+
+// StatusCode is the status carried in a StatusInfo attribute
+type StatusCode uint32
+
+// Constants for StatusCode values
+const (
+	StatusNoError                     = 0
+	StatusDuplicateAttribute          = 1
+	StatusUnrecognizedAttribute       = 2
+	StatusInvalidAttribValueLength    = 3
+	StatusValueNotSupported           = 4
+	StatusUnacceptedFrameReceived     = 5
+	StatusRetryCountExceeded          = 6
+	StatusInvalidFrameReceived        = 7
+	StatusNegotiationTimeout          = 8
+	StatusAttribNotSupportedInMsg     = 9
+	StatusRequiredAttributeMissing    = 10
+	StatusStatusInfoNotSupportedInMsg = 11
+)
+
+func (k StatusCode) String() string {
+	switch k {
+	case StatusNoError:
+		return "NoError"
+	case StatusDuplicateAttribute:
+		return "DuplicateAttribute"
+	case StatusUnrecognizedAttribute:
+		return "UnrecognizedAttribute"
+	case StatusInvalidAttribValueLength:
+		return "InvalidAttribValueLength"
+	case StatusValueNotSupported:
+		return "ValueNotSupported"
+	case StatusUnacceptedFrameReceived:
+		return "UnacceptedFrameReceived"
+	case StatusRetryCountExceeded:
+		return "RetryCountExceeded"
+	case StatusInvalidFrameReceived:
+		return "InvalidFrameReceived"
+	case StatusNegotiationTimeout:
+		return "NegotiationTimeout"
+	case StatusAttribNotSupportedInMsg:
+		return "AttribNotSupportedInMsg"
+	case StatusRequiredAttributeMissing:
+		return "RequiredAttributeMissing"
+	case StatusStatusInfoNotSupportedInMsg:
+		return "StatusInfoNotSupportedInMsg"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
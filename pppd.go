@@ -1,41 +1,406 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 )
 
 type pppdInstance struct {
 	commandInst *exec.Cmd
 	stdin       io.WriteCloser
-	unescaper   pppUnescaper
+	unescaper   *pppUnescaper
+	exited      chan struct{} // closed once pppd has been reaped
+	exitReason  string        // why pppd exited, once exited is closed
+	lcpSeen     atomic.Bool   // set once pppd sends an LCP packet, which ends its start timeout
+	stopping    chan struct{} // closed when the session stops pppd
 }
 
+// packetHandler receives frames from pppd's unescaper and queues them for the client
 type packetHandler struct {
-	conn     net.Conn
-	packChan chan []byte
+	session *session
+}
+
+func (p packetHandler) frame(data []byte) {
+	p.Write(data)
 }
 
 func (p packetHandler) Write(data []byte) (int, error) {
-	packetBytes := packDataPacketFast(data)
-	p.packChan <- packetBytes
+	if isAuthFailure(data) {
+		p.session.log().Warn("Authentication failed")
+		p.session.recordFailure(failureAuth)
+	}
+	if len(data) > maxFrameSize {
+		p.session.droppedFrame(errFrameTooLong, data)
+		return len(data), nil
+	}
+	if p.session.oversize("tx", data) {
+		return len(data), nil
+	}
+	if p.session.shaping.exceeded.Load() {
+		return len(data), nil
+	}
+	if !p.session.shapeData(len(data), false) {
+		return 0, io.ErrClosedPipe
+	}
+	// Copy the frame in after room for the SSTP header, and rewrite its PPP header in place
+	buf := getFrameBuffer()
+	frame := p.session.fromPPPD.compress(append(buf[sstpHeaderLength:sstpHeaderLength], data...))
+	p.session.fromPPPD.snoop(frame)
+	if pppd := &p.session.pppd; !pppd.lcpSeen.Load() {
+		if _, ok := lcpPacket(frame); ok {
+			pppd.lcpSeen.Store(true)
+		}
+	}
+	if cfg := p.session.server.config.PPP; cfg.ClampMSS {
+		clampMSS(frame, cfg.clampMRU())
+	}
+	p.session.observeFrame("tx", frame)
+	start := frameBufferSize - cap(frame)
+	packet := pooledFrame{buf, appendDataPacket(buf[start-sstpHeaderLength:start-sstpHeaderLength], frame)}
+	metricDataPackets.With("tx").Inc()
+	metricDataBytes.With("tx").Add(len(data))
+	if logDataFrames {
+		p.session.log().Debug("write data packet", "dump", hexDump(packet.data), "ppp", pppDump(frame))
+	}
+	if !p.session.downstream.push(p.session, packet) {
+		return 0, io.ErrClosedPipe
+	}
 	return len(data), nil
 }
 
-func createPPPD(pppdInstance *pppdInstance, conn net.Conn) {
-	pppdCmd := exec.Command("pppd", "notty", "file", "/etc/ppp/options.sstpd", "115200")
-	pppdIn, err := pppdCmd.StdinPipe()
-	handleErr(err)
-	pppdCmd.Stdout = pppdInstance.unescaper
-	err = pppdCmd.Start()
-	handleErr(err)
-	pppdInstance.commandInst = pppdCmd
-	pppdInstance.stdin = pppdIn
+// How frames are passed to and from pppd
+const (
+	pppFramingAsync = "async" // HDLC-like framing on pppd's stdin and stdout
+	pppFramingSync  = "sync"  // whole frames on a pty, without escaping or FCS
+)
+
+// pppdLogFD is the descriptor pppd writes its log to, the first of cmd.ExtraFiles
+const pppdLogFD = 3
+
+// pppdLinkname names a session's link, which pppd uses for its pid file and passes to scripts as
+// $LINKNAME
+func pppdLinkname(sessionID string) string {
+	return "sstp-" + sessionID
+}
+
+// pppdArgs returns pppd's arguments, using device in sync mode, or stdin and stdout if it is
+// empty. optionsFile is the session's generated options, if any.
+func pppdArgs(cfg pppConfig, device string, remote net.Addr, sessionID, optionsFile string) []string {
+	args := []string{"notty"}
+	if device != "" {
+		args = []string{device, "sync"}
+	}
+	// ipparam lets ip-up scripts identify the session, e.g. to set its limits through the admin interface
+	args = append(args, "ipparam", sessionID, "linkname", pppdLinkname(sessionID))
+	args = append(args, "logfd", strconv.Itoa(pppdLogFD))
+	// Let ip-up scripts see the client address, even behind a proxy
+	if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+		args = append(args, "remotenumber", host)
+	}
+	if cfg.OptionsFile != "" {
+		args = append(args, "file", cfg.OptionsFile)
+	}
+	if optionsFile != "" {
+		args = append(args, "file", optionsFile)
+	}
+	// An explicit MRU overrides the options files, so pppd negotiates no more than frames are
+	// checked against
+	if cfg.MRU != 0 {
+		args = append(args, "mru", strconv.Itoa(cfg.MRU), "mtu", strconv.Itoa(cfg.MRU))
+	}
+	if cfg.Speed > 0 {
+		args = append(args, strconv.Itoa(cfg.Speed))
+	}
+	return append(args, cfg.Args...)
+}
+
+func createPPPD(s *session) (err error) {
+	cfg := s.server.config.PPP
+	// Sync framing falls back to async if the pty can't be set up, e.g. without the n_hdlc module
+	var pty *os.File
+	var device string
+	if cfg.Framing == pppFramingSync {
+		var err error
+		pty, device, err = openSyncPTY()
+		if err != nil {
+			s.log().Warn("sync framing unavailable, falling back to async", "err", err)
+		}
+	}
+	// Whatever was opened for pppd is closed again if it can't be started
+	var opened []io.Closer
+	var optionsFile string
+	defer func() {
+		if err == nil {
+			return
+		}
+		metricPPPDSpawnFailures.Inc()
+		for _, c := range opened {
+			c.Close()
+		}
+		if optionsFile != "" {
+			os.Remove(optionsFile)
+		}
+	}()
+	if pty != nil {
+		opened = append(opened, pty)
+	}
+	optionsFile, err = s.writeSessionOptions()
+	if err != nil {
+		return fmt.Errorf("writing pppd session options: %w", err)
+	}
+
+	pppdCmd := exec.Command(cfg.Pppd, pppdArgs(cfg, device, s.conn.RemoteAddr(), s.id, optionsFile)...)
+	var pppdIn io.WriteCloser = pty
+	if pty == nil {
+		pppdIn, err = pppdCmd.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("creating pppd stdin: %w", err)
+		}
+		pppdCmd.Stdout = s.pppd.unescaper
+	}
+	// pppd's log, and anything it writes to stderr, go to the session's log. Only pppd keeps the
+	// write ends open once it has started.
+	logRead, logWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating pppd log pipe: %w", err)
+	}
+	defer logWrite.Close()
+	opened = append(opened, logRead)
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating pppd stderr pipe: %w", err)
+	}
+	defer stderrWrite.Close()
+	opened = append(opened, stderrRead)
+	pppdCmd.ExtraFiles = []*os.File{logWrite}
+	pppdCmd.Stderr = stderrWrite
+	// Don't wait forever for pppd's output to close if a child process keeps it open
+	pppdCmd.WaitDelay = time.Second
+	setProcessGroup(pppdCmd)
+	if err = pppdCmd.Start(); err != nil {
+		return fmt.Errorf("starting pppd: %w", err)
+	}
+	go s.logPPPD(logRead, slog.LevelInfo)
+	go s.logPPPD(stderrRead, slog.LevelWarn)
+
+	s.pppd.commandInst = pppdCmd
+	s.pppd.stdin = pppdIn
+	exited := make(chan struct{})
+	s.pppd.exited = exited
+	s.pppd.stopping = make(chan struct{})
+	go s.writePPPD(pppdIn, pty != nil, s.pppd.stopping, s.done)
+	if pty != nil {
+		go s.readSyncPPPD(pty)
+	}
 
+	pppd := &s.pppd
+	// A pppd which never starts LCP, e.g. stuck on a misconfigured plugin, fails the session
+	var startTimer *time.Timer
+	if timeout := s.server.config.Timeouts.PPPDStart; timeout > 0 {
+		startTimer = time.AfterFunc(timeout, func() {
+			if !pppd.lcpSeen.Load() {
+				s.fail(&abortError{StatusNoError, 0, fmt.Errorf("pppd sent no LCP within %v", timeout)})
+			}
+		})
+	}
+	stopping := s.pppd.stopping
 	go func() {
-		defer log.Print("pppd disconnected")
+		defer close(exited)
+		// Nothing pppd started, like a script still running, outlives it. The group is killed
+		// before pppd is reaped, while its ID can't belong to anything else.
+		if awaitExit(pppdCmd.Process) {
+			signalProcessGroup(pppdCmd.Process, syscall.SIGKILL)
+		}
 		pppdCmd.Wait()
+		if startTimer != nil {
+			startTimer.Stop()
+		}
+		if optionsFile != "" {
+			os.Remove(optionsFile)
+		}
+		code := pppdCmd.ProcessState.ExitCode()
+		pppd.exitReason = pppdExitReason(code)
+		metricPPPDExits.With(pppd.exitReason).Inc()
+		s.log().Info("pppd exited", "code", code, "reason", pppd.exitReason)
+		// Unless the session stopped it, the call can't go on without pppd
+		select {
+		case <-stopping:
+		default:
+			s.requestDisconnect(disconnectPPPD + pppd.exitReason)
+		}
 	}()
+	return nil
+}
+
+// logPPPD logs each line pppd writes to r to the session's log, until it is closed
+func (s *session) logPPPD(r io.ReadCloser, level slog.Level) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			s.log().Log(context.Background(), level, "pppd", "log", line)
+		}
+	}
+}
+
+// sessionOptionsData is what a ppp.session_options template can use
+type sessionOptionsData struct {
+	SessionID  string
+	Linkname   string
+	RemoteAddr string // the client's address, without a port, or empty if unknown
+}
+
+// loadSessionOptions parses the ppp.session_options template, or returns nil if none is configured
+func loadSessionOptions(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(path)).Parse(string(contents))
+}
+
+// writeSessionOptions writes the session's pppd options from the ppp.session_options template to
+// a temporary file, returning its path, or an empty path if there is no template
+func (s *session) writeSessionOptions() (string, error) {
+	tmpl := s.server.sessionOptions
+	if tmpl == nil {
+		return "", nil
+	}
+	data := sessionOptionsData{SessionID: s.id, Linkname: pppdLinkname(s.id)}
+	if host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String()); err == nil {
+		data.RemoteAddr = host
+	}
+	f, err := os.CreateTemp("", "sstp-go-"+s.id+"-*.options")
+	if err != nil {
+		return "", err
+	}
+	err = tmpl.Execute(f, data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// pppd's exit statuses, from its man page, as the reasons sessions' pppd exited
+var pppdExitReasons = []string{
+	0:  "normal",
+	1:  "fatal_error",
+	2:  "option_error",
+	3:  "not_root",
+	4:  "no_kernel_support",
+	5:  "signal",
+	6:  "lock_failed",
+	7:  "open_failed",
+	8:  "connect_failed",
+	9:  "pty_command_failed",
+	10: "negotiation_failed",
+	11: "peer_auth_failed",
+	12: "idle_timeout",
+	13: "connect_time",
+	14: "callback",
+	15: "peer_dead",
+	16: "hangup",
+	17: "loopback",
+	18: "init_failed",
+	19: "auth_failed",
+}
+
+// pppdExitReason describes an exit code, -1 meaning pppd was killed by a signal
+func pppdExitReason(code int) string {
+	switch {
+	case code == -1:
+		return "killed"
+	case code >= 0 && code < len(pppdExitReasons):
+		return pppdExitReasons[code]
+	}
+	return "unknown"
+}
+
+// readSyncPPPD queues frames from pppd's sync pty for the client, one frame per read, until pppd
+// exits or the session closes the pty
+func (s *session) readSyncPPPD(pty io.Reader) {
+	buf := getFrameBuffer()
+	defer releaseFrameBuffer(buf)
+	handler := packetHandler{s}
+	for {
+		n, err := pty.Read(buf[:])
+		if n > maxFrameSize {
+			s.droppedFrame(errFrameTooLong, buf[:n])
+			continue
+		}
+		if errors.Is(err, syscall.EOVERFLOW) {
+			// N_HDLC discards frames too big for the buffer
+			s.droppedFrame(errFrameTooLong, nil)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := handler.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// stopPPPD terminates the session's pppd, if it has been started. pppd is sent SIGTERM so it
+// can run its disconnect scripts, and is killed if it hasn't exited after timeouts.pppd_stop.
+func (s *session) stopPPPD() {
+	if s.pppd.commandInst == nil {
+		return
+	}
+	process := s.pppd.commandInst.Process
+	close(s.pppd.stopping)
+	s.pppd.stdin.Close()
+	err := s.signalPPPD(process, syscall.SIGTERM)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		s.log().Warn("failed to terminate pppd", "err", err)
+	}
+
+	timer := time.NewTimer(s.server.config.Timeouts.PPPDStop)
+	defer timer.Stop()
+	select {
+	case <-s.pppd.exited:
+	case <-timer.C:
+		s.log().Warn("pppd did not exit after SIGTERM, killing it")
+		err = s.signalPPPD(process, syscall.SIGKILL)
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			s.log().Warn("failed to kill pppd", "err", err)
+		}
+		<-s.pppd.exited
+	}
+	s.pppd.commandInst = nil
+}
+
+// signalPPPD signals pppd and anything it started together, unless pppd has already been reaped
+// and its process ID may have been reused
+func (s *session) signalPPPD(process *os.Process, sig syscall.Signal) error {
+	select {
+	case <-s.pppd.exited:
+		return os.ErrProcessDone
+	default:
+	}
+	return signalProcessGroup(process, sig)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// logBuffer collects log output from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// fakePPPD returns the default config with pppd replaced by a shell script and no options file,
+// and the script's path, which it can keep its own files next to
+func fakePPPD(t *testing.T, script string) (*config, string) {
+	t.Helper()
+	pppd := filepath.Join(t.TempDir(), "pppd")
+	if err := os.WriteFile(pppd, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.PPP.Pppd = pppd
+	cfg.PPP.OptionsFile = ""
+	return cfg, pppd
+}
+
+// idlePPPD is a fake pppd which reads the client's frames until it is stopped
+const idlePPPD = "exec cat > /dev/null\n"
+
+func TestPPPDSessionMetadata(t *testing.T) {
+	template := filepath.Join(t.TempDir(), "session.options")
+	if err := os.WriteFile(template, []byte("# {{.SessionID}}\nlinkname-check {{.Linkname}}\nremote-check {{.RemoteAddr}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The fake pppd records its arguments and the options in the last file it is given, logs to
+	// its log descriptor and stderr, and exits as if the client failed to authenticate
+	cfg, pppd := fakePPPD(t, "echo \"$@\" > \"$0.args\"\nself=\"$0\"\n"+
+		"while [ $# -gt 1 ]; do [ \"$1\" = file ] && cp \"$2\" \"$self.options\"; shift; done\n"+
+		"echo 'Using interface ppp0' >&3\necho 'bad option' >&2\nexit 11\n")
+	cfg.PPP.SessionOptions = template
+	if err := cfg.validate(); err != nil && strings.Contains(err.Error(), "ppp.session_options") {
+		t.Fatal(err)
+	}
+	logs := &logBuffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	exits := atomic.LoadUint64(&metricPPPDExits.With("peer_auth_failed").value)
+
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+	s := srv.sessions()[0]
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	for start := time.Now(); atomic.LoadUint64(&metricPPPDExits.With("peer_auth_failed").value) == exits; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("pppd's exit was not counted")
+		}
+	}
+
+	args, _ := os.ReadFile(pppd + ".args")
+	if !bytes.Contains(args, []byte("ipparam "+s.id+" linkname sstp-"+s.id+" logfd 3 ")) {
+		t.Errorf("expected the session's ipparam, linkname and logfd, got %q", args)
+	}
+	// net.Pipe has no address to pass on
+	options, _ := os.ReadFile(pppd + ".options")
+	if expected := "# " + s.id + "\nlinkname-check sstp-" + s.id + "\nremote-check \n"; string(options) != expected {
+		t.Errorf("expected options %q, got %q", expected, options)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(os.TempDir(), "sstp-go-"+s.id+"-*")); len(leftover) != 0 {
+		t.Errorf("session options not removed: %v", leftover)
+	}
+	for start := time.Now(); !strings.Contains(logs.String(), "bad option"); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			break
+		}
+	}
+	output := logs.String()
+	for _, line := range []string{`level=INFO msg=pppd session=` + s.id, `log="Using interface ppp0"`, `level=WARN msg=pppd`, `log="bad option"`, `reason=peer_auth_failed`} {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected %q in the session's log:\n%s", line, output)
+		}
+	}
+}
+
+func TestPPPDExitReason(t *testing.T) {
+	for code, expected := range map[int]string{0: "normal", 11: "peer_auth_failed", 19: "auth_failed", -1: "killed", 42: "unknown"} {
+		if reason := pppdExitReason(code); reason != expected {
+			t.Errorf("exit status %d: expected %s, got %s", code, expected, reason)
+		}
+	}
+}
+
+func TestPPPDExitDisconnects(t *testing.T) {
+	cfg, _ := fakePPPD(t, "exit 15\n")
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+	s := srv.sessions()[0]
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	expectControl(t, client, MessageTypeCallDisconnect)
+	client.Write(controlPacket(MessageTypeCallDisconnectAck))
+	expectClosed(t, client)
+	if s.disconnectReason != disconnectPPPD+"peer_dead" {
+		t.Errorf("expected pppd's exit as the reason, got %q", s.disconnectReason)
+	}
+}
+
+func TestPPPDStartTimeout(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	cfg.Timeouts.PPPDStart = 50 * time.Millisecond
+	client := pipeSSTP(t, newServer(cfg))
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	expectAbortStatus(t, client, StatusNoError)
+	expectClosed(t, client)
+}
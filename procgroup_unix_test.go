@@ -0,0 +1,119 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processGone reports whether a process has exited, counting a zombie no one reaps as gone
+func processGone(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) != nil
+	}
+	// The state follows the command name in parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestPPPDProcessGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		// pppd exits, leaving a script running
+		{"exited", "exit 1\n"},
+		// the session ends and stops pppd, which has a script running
+		{"stopped", "exec cat > /dev/null\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, pppd := fakePPPD(t, "sleep 30 </dev/null >/dev/null 2>&1 3>&- &\necho $! > \"$0.child\"\n"+test.script)
+			client := pipeSSTP(t, newServer(cfg))
+			client.Write(connectRequestPacket())
+			expectControl(t, client, MessageTypeCallConnectAck)
+
+			var child int
+			for start := time.Now(); child == 0 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				if contents, err := os.ReadFile(pppd + ".child"); err == nil {
+					child, _ = strconv.Atoi(strings.TrimSpace(string(contents)))
+				}
+			}
+			if child == 0 {
+				t.Fatal("fake pppd did not start its child")
+			}
+			// After pppd exits on its own, the child is killed while the session is still up
+			if test.name == "exited" {
+				if runtime.GOOS != "linux" {
+					syscall.Kill(child, syscall.SIGKILL)
+					t.Skip("pppd's group is only killed after it exits on Linux")
+				}
+				expectControl(t, client, MessageTypeCallDisconnect)
+			} else {
+				client.Close()
+			}
+			for start := time.Now(); !processGone(child); time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					syscall.Kill(child, syscall.SIGKILL)
+					t.Fatalf("pppd's child (pid %d) was orphaned", child)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownTerminatesPPPD(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		// pppd exits cleanly on SIGTERM
+		{"terminated", "trap 'echo stopped > \"$0.terminated\"; exit 0' TERM\n"},
+		// pppd ignores SIGTERM and has to be killed
+		{"killed", "trap '' TERM\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, pppd := fakePPPD(t, test.script+"echo $$ > \"$0.pid\"\nwhile :; do sleep 0.05; done\n")
+			cfg.Timeouts.PPPDStop = 200 * time.Millisecond
+			srv := newServer(cfg)
+			client := pipeSSTP(t, srv)
+			client.Write(connectRequestPacket())
+			expectControl(t, client, MessageTypeCallConnectAck)
+
+			var pid int
+			for start := time.Now(); pid == 0 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				if contents, err := os.ReadFile(pppd + ".pid"); err == nil {
+					pid, _ = strconv.Atoi(strings.TrimSpace(string(contents)))
+				}
+			}
+			if pid == 0 {
+				t.Fatal("fake pppd did not start")
+			}
+
+			result := shutdownAsync(srv, 5*time.Second)
+			expectControl(t, client, MessageTypeCallDisconnect)
+			client.Write(controlPacket(MessageTypeCallDisconnectAck))
+			expectClosed(t, client)
+			<-result
+
+			if syscall.Kill(pid, 0) == nil {
+				t.Fatalf("pppd (pid %d) still running after shutdown", pid)
+			}
+			_, err := os.Stat(pppd + ".terminated")
+			if (test.name == "terminated") != (err == nil) {
+				t.Fatalf("SIGTERM handler ran: %v", err == nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// waitid constants from <sys/wait.h>
+const (
+	waitPID     = 1 // P_PID
+	waitExited  = 0x4
+	waitNoReap  = 0x1000000 // WNOWAIT
+	siginfoSize = 128
+)
+
+// awaitExit blocks until p exits without reaping it, so its process ID, and the ID of the group it
+// leads, can't be reused until it is waited for
+func awaitExit(p *os.Process) bool {
+	var siginfo [siginfoSize]byte
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, waitPID, uintptr(p.Pid),
+			uintptr(unsafe.Pointer(&siginfo)), waitExited|waitNoReap, 0, 0)
+		if errno != syscall.EINTR {
+			return errno == 0
+		}
+	}
+}
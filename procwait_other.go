@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// awaitExit can't wait for a process without reaping it here, so the group pppd leads isn't
+// signalled once pppd exits
+func awaitExit(p *os.Process) bool {
+	return false
+}
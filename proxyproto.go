@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* PROXY protocol versions 1 and 2
+ * https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+ */
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyV1MaxLength = 107
+
+// Fixed part of a v2 header after the signature: version/command, family/protocol and length
+const proxyV2HeaderLength = 4
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r without reading past it.
+// source and destination are nil if the header doesn't carry addresses (LOCAL or UNKNOWN).
+func readProxyHeader(r io.Reader) (source net.Addr, destination net.Addr, err error) {
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(r, start)
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyV1(r io.Reader, start []byte) (net.Addr, net.Addr, error) {
+	line := start
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	source, err := parseProxyV1Address(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseProxyV1Address(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func parseProxyV1Address(ip string, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY v1 header", ip)
+	}
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY v1 header", port)
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+func readProxyV2(r io.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", header[0]>>4)
+	}
+	command := header[0] & 0xf
+	family := header[1]
+	addresses := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0: // LOCAL: health checks from the proxy itself
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	var ipLength int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLength = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLength = net.IPv6len
+	default: // UNSPEC, UDP or unix sockets: keep the real addresses
+		return nil, nil, nil
+	}
+	if len(addresses) < 2*ipLength+4 {
+		return nil, nil, errors.New("PROXY v2 address block too short")
+	}
+	source := &net.TCPAddr{
+		IP:   net.IP(addresses[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLength:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(addresses[ipLength : 2*ipLength]),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLength+2:])),
+	}
+	return source, destination, nil
+}
+
+// proxyListener accepts connections which start with a PROXY protocol header.
+// Connections from trusted sources must send a header; others are served with their real address.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet // TCP sources which must send a header
+}
+
+func newProxyListener(l net.Listener, trusted []*net.IPNet) *proxyListener {
+	return &proxyListener{l, trusted}
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets can only be reached locally
+		return true
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn reads the PROXY protocol header on first use, so a slow client doesn't block Accept
+type proxyConn struct {
+	net.Conn
+	once        sync.Once
+	err         error
+	source      net.Addr
+	destination net.Addr
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.source, c.destination, c.err = readProxyHeader(c.Conn)
+		if c.err != nil {
+			metricProxyProtocolErrors.Inc()
+			slog.Warn("Invalid PROXY protocol header", "proxy", c.Conn.RemoteAddr().String(), "err", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address given by the proxy
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to on the proxy
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// parseCIDRs parses networks in CIDR notation; a bare address is a single host network
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
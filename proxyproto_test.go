@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xd4, 0x31, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0xd4, 0x31, 0x01, 0xbb)
+
+	tests := []struct {
+		name        string
+		header      []byte
+		source      string
+		destination string
+		err         string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 54321 443\r\n"), "203.0.113.7:54321", "192.0.2.1:443", ""},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 54321 443\r\n"), "[2001:db8::7]:54321", "[2001:db8::1]:443", ""},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", "", ""},
+		{"v1 malformed", []byte("PROXY TCP4 203.0.113.7\r\n"), "", "", "malformed PROXY v1 header"},
+		{"v1 bad address", []byte("PROXY TCP4 example 192.0.2.1 54321 443\r\n"), "", "", "invalid address"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", "", "too long"},
+		{"v2 TCP4", proxyV2Header(1, 0x11, ipv4), "203.0.113.7:54321", "192.0.2.1:443", ""},
+		{"v2 TCP6", proxyV2Header(1, 0x21, ipv6), "[2001:db8::7]:54321", "[2001:db8::1]:443", ""},
+		{"v2 TLVs", proxyV2Header(1, 0x11, append(ipv4, 0x04, 0, 1, 0)), "203.0.113.7:54321", "192.0.2.1:443", ""},
+		{"v2 LOCAL", proxyV2Header(0, 0, nil), "", "", ""},
+		{"v2 short", proxyV2Header(1, 0x11, ipv4[:8]), "", "", "too short"},
+		{"missing", []byte("SSTP_DUPLEX_POST /sra_"), "", "", "missing PROXY protocol header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The header must be consumed exactly, leaving the rest of the stream
+			r := bytes.NewReader(append(test.header, "rest"...))
+			source, destination, err := readProxyHeader(r)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (source == nil && test.source != "") || (source != nil && source.String() != test.source) {
+				t.Errorf("source = %v, expected %q", source, test.source)
+			}
+			if (destination == nil && test.destination != "") || (destination != nil && destination.String() != test.destination) {
+				t.Errorf("destination = %v, expected %q", destination, test.destination)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Errorf("header not consumed exactly, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListenerTrust(t *testing.T) {
+	tests := []struct {
+		name     string
+		trusted  []string
+		expected string // "" for the real address
+		data     string
+	}{
+		{"trusted", []string{"127.0.0.0/8"}, "203.0.113.7:54321", "hello"},
+		{"nobody trusted", nil, "", "PROXY TCP4 203.0.113.7 192.0.2.1 54321 443\r\nhello"},
+		{"untrusted", []string{"10.0.0.0/8"}, "", "PROXY TCP4 203.0.113.7 192.0.2.1 54321 443\r\nhello"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trusted, err := parseCIDRs(test.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := newProxyListener(tcpListener, trusted)
+			defer l.Close()
+
+			client := dialTest(t, l.Addr().String())
+			io.WriteString(client, "PROXY TCP4 203.0.113.7 192.0.2.1 54321 443\r\nhello")
+			client.(*net.TCPConn).CloseWrite()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			expected := test.expected
+			if expected == "" {
+				expected = client.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != expected {
+				t.Errorf("RemoteAddr = %v, expected %v", conn.RemoteAddr(), expected)
+			}
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.data {
+				t.Errorf("read %q, expected %q", data, test.data)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.1.2.3", "192.0.2.1", "2001:db8::1"} {
+		found := false
+		for _, network := range networks {
+			found = found || network.Contains(net.ParseIP(ip))
+		}
+		if !found {
+			t.Errorf("%s not matched", ip)
+		}
+	}
+	if networks[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Error("bare address matched another host")
+	}
+	if _, err := parseCIDRs([]string{"not-an-address"}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// server accepts SSTP connections and runs their sessions
+type server struct {
+	config *config
+	// decoy serves HTTP requests which aren't SSTP, if configured
+	decoy   http.Handler
+	limiter *connLimiter
+	// rates limits new connections per address and per address prefix
+	rates       *rateLimiter
+	prefixRates *rateLimiter
+	bans        *banList
+	// sessionOptions renders extra pppd options for each session, if configured
+	sessionOptions *template.Template
+
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]struct{}
+	// conns maps every open connection to its session, or nil during the HTTP handshake
+	conns map[net.Conn]*session
+	wg    sync.WaitGroup
+	// usage counts each user's bytes for period quotas
+	usage map[string]*periodUsage
+
+	// disconnectAcks counts sessions that acknowledged a server CallDisconnect during shutdown
+	disconnectAcks int64
+}
+
+// newServer creates a server for a configuration, which must have been validated
+func newServer(cfg *config) *server {
+	decoy, _ := newDecoyHandler(cfg.Decoy)
+	bans, err := newBanList(cfg.Bans)
+	if err != nil {
+		slog.Warn("Failed to load saved bans", "file", cfg.Bans.File, "err", err)
+	}
+	// A template which doesn't load has already failed validation
+	sessionOptions, _ := loadSessionOptions(cfg.PPP.SessionOptions)
+	return &server{
+		config:         cfg,
+		sessionOptions: sessionOptions,
+		decoy:          decoy,
+		limiter:        newConnLimiter(cfg.Limits),
+		rates:          newRateLimiter(cfg.Limits.ConnectionsPerMinute, cfg.Limits.ConnectionBurst),
+		prefixRates:    newRateLimiter(cfg.Limits.PrefixConnectionsPerMinute, cfg.Limits.PrefixConnectionBurst),
+		bans:           bans,
+		listeners:      make(map[net.Listener]struct{}),
+		conns:          make(map[net.Conn]*session),
+		usage:          make(map[string]*periodUsage),
+	}
+}
+
+// sessions returns the established sessions
+func (srv *server) sessions() []*session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var sessions []*session
+	for _, s := range srv.conns {
+		if s != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// admit checks a new connection's client address against the ban list and rate limits,
+// returning the reason it is rejected or an empty string
+func (srv *server) admit(ip net.IP) string {
+	now := time.Now()
+	if srv.bans.isBanned(ip.String(), now) {
+		return "banned"
+	}
+	if !srv.rates.allow(ip.String(), now) || !srv.prefixRates.allow(addressPrefix(ip), now) {
+		return "rate_limit"
+	}
+	return ""
+}
+
+// serve accepts connections on l until it fails or the server shuts down, handling them with
+// the listener's settings. Errors in a connection only affect that connection.
+func (srv *server) serve(l net.Listener, settings *listenerSettings) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+
+	var backoff time.Duration
+	for {
+		// Wait for a connection.
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosing() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// Anything else, like running out of file descriptors, may pass, so back off and
+			// retry as net/http does
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			slog.Warn("Accept failed", "err", err, "retry", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		// Handle the connection in a new goroutine.
+		// The loop then returns to accepting, so that
+		// multiple connections may be served concurrently.
+		go srv.handleConnection(conn, settings)
+	}
+}
+
+func (srv *server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// trackConn registers a new connection, returning false if the server is shutting down
+func (srv *server) trackConn(c net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.conns[c] = nil
+	srv.wg.Add(1)
+	return true
+}
+
+func (srv *server) untrackConn(c net.Conn) {
+	srv.mu.Lock()
+	delete(srv.conns, c)
+	srv.mu.Unlock()
+	srv.wg.Done()
+}
+
+// trackSession records that c has completed the handshake, returning false if the server is shutting down
+func (srv *server) trackSession(c net.Conn, s *session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.conns[c] = s
+	return true
+}
+
+type shutdownSummary struct {
+	sessions     int // sessions open when shutdown started
+	acknowledged int // sessions which acknowledged the CallDisconnect
+	forced       int // sessions closed when the deadline expired
+}
+
+// shutdown stops accepting connections and disconnects every session, waiting until
+// they have all ended. Sessions still open when ctx expires are closed.
+func (srv *server) shutdown(ctx context.Context) shutdownSummary {
+	var summary shutdownSummary
+
+	srv.mu.Lock()
+	srv.closing = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for c, s := range srv.conns {
+		if s == nil {
+			// Still in the HTTP handshake, there is no call to disconnect
+			c.Close()
+			continue
+		}
+		summary.sessions++
+		s.requestDisconnect(disconnectShutdown)
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.mu.Lock()
+		for c, s := range srv.conns {
+			if s != nil {
+				summary.forced++
+				s.log().Warn("Session did not disconnect in time, closing")
+			}
+			c.Close()
+		}
+		srv.mu.Unlock()
+		<-done
+	}
+
+	summary.acknowledged = int(atomic.LoadInt64(&srv.disconnectAcks))
+	return summary
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pipeSSTP starts a session on srv over net.Pipe, returning the client end once the session is registered
+func pipeSSTP(t *testing.T, srv *server) net.Conn {
+	client, serverConn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	settings, err := newListenerSettings(srv.config.Listeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.handleConnection(serverConn, settings)
+	handshakeSSTP(t, client)
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		s := srv.conns[serverConn]
+		srv.mu.Unlock()
+		if s != nil {
+			return client
+		}
+	}
+	t.Fatal("session was not registered")
+	return nil
+}
+
+func shutdownAsync(srv *server, timeout time.Duration) <-chan shutdownSummary {
+	result := make(chan shutdownSummary, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		result <- srv.shutdown(ctx)
+	}()
+	return result
+}
+
+func TestShutdownDisconnectsSessions(t *testing.T) {
+	srv := newServer(defaultConfig())
+	clients := []net.Conn{pipeSSTP(t, srv), pipeSSTP(t, srv)}
+
+	result := shutdownAsync(srv, 5*time.Second)
+	for _, client := range clients {
+		expectControl(t, client, MessageTypeCallDisconnect)
+		client.Write(controlPacket(MessageTypeCallDisconnectAck))
+		expectClosed(t, client)
+	}
+
+	summary := <-result
+	if summary != (shutdownSummary{sessions: 2, acknowledged: 2}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv := newServer(defaultConfig())
+	client := pipeSSTP(t, srv)
+
+	result := shutdownAsync(srv, 100*time.Millisecond)
+	expectControl(t, client, MessageTypeCallDisconnect)
+	// Never acknowledge, so the session is closed at the deadline
+	expectClosed(t, client)
+
+	summary := <-result
+	if summary != (shutdownSummary{sessions: 1, forced: 1}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestShutdownStopsAccepting(t *testing.T) {
+	srv := newServer(defaultConfig())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	settings, _ := newListenerSettings(srv.config.Listeners[0])
+	go func() { serveErr <- srv.serve(l, settings) }()
+
+	// A connection still in the HTTP handshake is closed without waiting for it
+	conn := dialTest(t, l.Addr().String())
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		tracked := len(srv.conns)
+		srv.mu.Unlock()
+		if tracked == 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection was not tracked")
+		}
+	}
+
+	summary := <-shutdownAsync(srv, 5*time.Second)
+	if summary != (shutdownSummary{}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	expectClosed(t, conn)
+	if err := <-serveErr; err != nil {
+		t.Fatalf("serve returned %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("listener still accepting after shutdown")
+	}
+}
+
+// failingListener fails to accept a few times, as when out of file descriptors, then accepts conn
+// and reports itself closed
+type failingListener struct {
+	net.Listener
+	failures int
+	conn     net.Conn
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error { return nil }
+
+func TestServeRetriesAcceptErrors(t *testing.T) {
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	srv := newServer(defaultConfig())
+	settings, err := newListenerSettings(srv.config.Listeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &failingListener{failures: 4, conn: serverConn}
+	start := time.Now()
+	if err := srv.serve(l, settings); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected serve to return once the listener closed, got %v", err)
+	}
+	// 5, 10, 20 and 40ms of backoff
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Errorf("expected serve to back off, took %v", elapsed)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	handshakeSSTP(t, client)
+}
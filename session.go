@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session holds the state of a single SSTP connection once the HTTP handshake has completed
+type session struct {
+	server *server
+	id     string
+	conn   net.Conn
+	// logger is replaced once the user is known, while other goroutines log; use log()
+	logger   atomic.Pointer[slog.Logger]
+	username string
+	pppd     pppdInstance
+
+	// nonce is sent in CallConnectAck and must be returned in the client's crypto binding
+	nonce      [cryptoBindingNonceLength]byte
+	certHashes [][]byte
+	connected  bool
+	// connectNaks counts CallConnectRequests refused for an unsupported protocol
+	connectNaks int
+	// clientIP is the address failures are counted against for bans, or empty if unknown
+	clientIP string
+	// releasePreAuth frees the connection's unauthenticated slot once the call is connected
+	releasePreAuth func()
+
+	// disconnect is closed to ask the session to send a CallDisconnect, for disconnectReason
+	disconnect       chan struct{}
+	disconnectOnce   sync.Once
+	disconnectReason string
+
+	shaping sessionShaping
+	// upstream holds frames from the client for pppd, downstream frames from pppd for the client
+	upstream   *packetQueue
+	downstream *packetQueue
+	// control holds control messages for the client, which are written ahead of data
+	control chan []byte
+	// toPPPD follows what pppd negotiated to receive, fromPPPD what the client did
+	toPPPD, fromPPPD pppLink
+
+	// capture is the session's running packet capture, if any; captureMu serialises starting
+	// and stopping it
+	capture   atomic.Pointer[sessionCapture]
+	captureMu sync.Mutex
+	// failed is closed when a writer fails, with the error in failErr
+	failed   chan struct{}
+	failOnce sync.Once
+	failErr  error
+	// done is closed when run returns
+	done <-chan struct{}
+}
+
+// Reasons the server disconnects a session
+const (
+	disconnectShutdown = "shutdown"
+	disconnectQuota    = "quota"
+	disconnectAdmin    = "admin"
+	disconnectPPPD     = "pppd_" // followed by why pppd exited
+)
+
+// abortError is a failure that ends a single session; the client is sent a CallAbort with status
+type abortError struct {
+	status      StatusCode
+	attributeID AttributeID
+	err         error
+}
+
+func (e *abortError) Error() string {
+	if e.status == StatusNoError {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%v (%v)", e.err, e.status)
+}
+
+func (e *abortError) Unwrap() error {
+	return e.err
+}
+
+// errClientAborted is returned when the client sends a CallAbort
+var errClientAborted = errors.New("connection aborted by client")
+
+// errDisconnected is returned when the client acknowledges a CallDisconnect sent by the server
+var errDisconnected = errors.New("disconnected by server")
+
+func newSessionID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+func newSession(srv *server, conn net.Conn) *session {
+	id := newSessionID()
+	s := &session{
+		server:     srv,
+		id:         id,
+		conn:       conn,
+		disconnect: make(chan struct{}),
+		upstream:   newPacketQueue("rx", srv.config.Queues.Upstream, srv.config.Queues.Policy),
+		downstream: newPacketQueue("tx", srv.config.Queues.Downstream, srv.config.Queues.Policy),
+		control:    make(chan []byte, 8),
+		toPPPD:     newPPPLink(srv.config.PPP),
+		fromPPPD:   newPPPLink(srv.config.PPP),
+		failed:     make(chan struct{}),
+		nonce:      newNonce(),
+	}
+	s.logger.Store(slog.Default().With("session", id, "remote", conn.RemoteAddr().String()))
+	s.setLimits(srv.config.Shaping.shapingLimits, false)
+	return s
+}
+
+// log returns the session's logger
+func (s *session) log() *slog.Logger {
+	return s.logger.Load()
+}
+
+// PPP protocol numbers used when looking for the authenticating user
+const (
+	pppProtocolPAP  = 0xc023
+	pppProtocolCHAP = 0xc223
+)
+
+// authPacket returns the protocol and packet of a PAP or CHAP frame, trimmed to its length field
+func authPacket(frame []byte) (uint16, []byte, bool) {
+	protocol, packet, ok := pppHeader(frame)
+	if !ok || protocol != pppProtocolPAP && protocol != pppProtocolCHAP {
+		return 0, nil, false
+	}
+	if len(packet) < 4 {
+		return 0, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if length > len(packet) || length < 4 {
+		return 0, nil, false
+	}
+	return protocol, packet[:length], true
+}
+
+// snoopUsername extracts the peer name from a PAP Authenticate-Request or CHAP Response
+// sent by the client, so it can be attached to the session logger
+func snoopUsername(frame []byte) (string, bool) {
+	protocol, packet, ok := authPacket(frame)
+	if !ok {
+		return "", false
+	}
+
+	switch protocol {
+	case pppProtocolPAP:
+		// Code 1: Authenticate-Request, Peer-ID Length, Peer-ID
+		if packet[0] != 1 || len(packet) < 5 {
+			return "", false
+		}
+		nameLength := int(packet[4])
+		if 5+nameLength > len(packet) {
+			return "", false
+		}
+		return string(packet[5 : 5+nameLength]), true
+	case pppProtocolCHAP:
+		// Code 2: Response, Value-Size, Value, Name
+		if packet[0] != 2 || len(packet) < 5 {
+			return "", false
+		}
+		nameStart := 5 + int(packet[4])
+		if nameStart > len(packet) {
+			return "", false
+		}
+		return string(packet[nameStart:]), true
+	}
+	return "", false
+}
+
+// isAuthFailure reports whether a frame sent by pppd rejects the client's credentials:
+// a PAP Authenticate-Nak or a CHAP (including MS-CHAP) Failure
+func isAuthFailure(frame []byte) bool {
+	protocol, packet, ok := authPacket(frame)
+	if !ok {
+		return false
+	}
+	return protocol == pppProtocolPAP && packet[0] == 3 || protocol == pppProtocolCHAP && packet[0] == 4
+}
+
+func (s *session) setUsername(username string) {
+	if s.username == username {
+		return
+	}
+	s.shaping.mu.Lock()
+	s.username = username
+	s.shaping.mu.Unlock()
+	s.logger.Store(s.log().With("user", username))
+	s.log().Info("client authenticating")
+	s.startUserShaping(username)
+}
+
+// run processes SSTP packets until the client disconnects or the session fails.
+// A nil error means the client closed the connection.
+func (s *session) run() error {
+	ch := make(chan parseReturn)
+	eCh := make(chan error, 1)
+	done := make(chan struct{})
+	writerDone := make(chan struct{})
+	defer func() {
+		close(done)
+		<-writerDone
+	}()
+	s.done = done
+
+	s.pppd = pppdInstance{unescaper: newUnescaper(packetHandler{s}.frame, s.droppedFrame)} // store null pointer to future pppd instance
+	if s.fromPPPD.accm {
+		s.pppd.unescaper.receiveMap = &s.fromPPPD.asyncMap
+	}
+	disconnect := s.disconnect
+	// disconnectTimeout fires if the client doesn't acknowledge a CallDisconnect in time
+	var disconnectTimeout <-chan time.Time
+	// negotiationTimeout fires if the call isn't connected in time, as MS-SSTP's negotiation timer
+	var negotiationTimeout <-chan time.Time
+	if timeout := s.server.config.Timeouts.Negotiation; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		negotiationTimeout = timer.C
+	}
+
+	// Start a goroutine to read from our net connection
+	go func() {
+		for first := true; ; first = false {
+			// try to read the data
+			var data [4]byte
+			_, err := io.ReadFull(s.conn, data[:])
+			if err != nil {
+				// send an error if it's encountered
+				eCh <- s.readError(first, err)
+				return
+			}
+			isControl, lengthToRead, err := decodeHeader(data[:])
+			if err != nil {
+				eCh <- &abortError{StatusInvalidFrameReceived, 0, err}
+				return
+			}
+			frame := newPooledFrame(lengthToRead)
+			_, err = io.ReadFull(s.conn, frame.data)
+			if err != nil {
+				frame.release()
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				eCh <- s.readError(first, err)
+				return
+			}
+			// The first message's deadline covers all of it, so a client can't stall halfway
+			if first {
+				s.conn.SetReadDeadline(time.Time{})
+			}
+			select {
+			case ch <- parseReturn{isControl, frame}:
+			case <-done:
+				frame.release()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(writerDone)
+		s.writeClient(done)
+	}()
+
+	// continuously read from the connection
+	for {
+		select {
+		case data := <-ch: // This case means we recieved data on the connection
+			var err error
+			if data.isControl {
+				s.log().Debug("read control packet", "dump", hexDump(data.data))
+				s.captureReceivedControl(data.data)
+				var header sstpControlHeader
+				header, err = parseControl(data.data)
+				if err != nil {
+					err = &abortError{StatusInvalidFrameReceived, 0, err}
+				} else {
+					err = handleControlPacket(header, s)
+				}
+				data.release()
+				if s.connected {
+					negotiationTimeout = nil
+				}
+			} else {
+				if logDataFrames {
+					s.log().Debug("read data packet", "dump", hexDump(data.data), "ppp", pppDump(data.data))
+				}
+				err = handleDataPacket(data.pooledFrame, s)
+			}
+			if err != nil {
+				return err
+			}
+		case err := <-eCh: // This case means we got an error and the goroutine has finished
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-s.failed: // A writer couldn't deliver data
+			return s.failErr
+		case <-disconnect: // The server is shutting down
+			disconnect = nil
+			s.log().Info("Disconnecting session", "reason", s.disconnectReason)
+			err := sendCallDisconnectPacket(s)
+			if err != nil {
+				return err
+			}
+			timer := time.NewTimer(s.server.config.Timeouts.DisconnectAck)
+			defer timer.Stop()
+			disconnectTimeout = timer.C
+		case <-disconnectTimeout:
+			return &abortError{StatusNoError, 0, fmt.Errorf("no CallDisconnectAck within %v", s.server.config.Timeouts.DisconnectAck)}
+		case <-negotiationTimeout:
+			metricConnectionsRejected.With("timeout").Inc()
+			return &abortError{StatusNoError, 0, fmt.Errorf("call not connected within %v", s.server.config.Timeouts.Negotiation)}
+		}
+	}
+}
+
+// readError describes an error reading a message from the client, counting a timeout on the first
+// message as a rejected connection
+func (s *session) readError(first bool, err error) error {
+	var netErr net.Error
+	if first && errors.As(err, &netErr) && netErr.Timeout() {
+		metricConnectionsRejected.With("timeout").Inc()
+		return fmt.Errorf("no SSTP message received: %w", err)
+	}
+	return err
+}
+
+// droppedFrame reports a frame from pppd which the unescaper couldn't pass on
+func (s *session) droppedFrame(err frameError, frame []byte) {
+	if err == errBadFCS {
+		metricFCSErrors.Inc()
+	} else {
+		metricMalformedFrames.With(string(err)).Inc()
+	}
+	s.log().Warn("Dropped frame from pppd", "err", err, "length", len(frame))
+	if logDataFrames {
+		s.log().Debug("dropped frame", "dump", hexDump(frame))
+	}
+}
+
+// observeFrame logs LCP, NCP and authentication frames, decoded, at debug level, and counts the
+// authentication method and MRUs LCP settles on. Other frames are left alone, so forwarding data
+// stays cheap.
+func (s *session) observeFrame(direction string, frame []byte) {
+	s.captureFrame(direction == "rx", frame)
+	protocol, _, ok := pppHeader(frame)
+	if !ok || protocol < 0x8000 {
+		return
+	}
+	s.log().Debug("PPP frame", "direction", direction, "ppp", pppDump(frame))
+	if protocol != pppProtocolLCP {
+		return
+	}
+	f, err := decodePPP(frame)
+	lcp, ok := f.controlPacket(pppProtocolLCP)
+	if err != nil || !ok || lcp.Code != lcpConfigureAck {
+		return
+	}
+	if direction == "rx" {
+		// The client acknowledged pppd's options, including how the client must authenticate
+		if method, ok := lcp.authMethod(); ok {
+			metricAuthMethods.With(method).Inc()
+		}
+	} else {
+		// pppd acknowledged the client's options, including the MRU the client receives
+		metricNegotiatedMRU.Observe(float64(lcp.mru()))
+	}
+}
+
+// recordFailure counts a client failure towards banning its address
+func (s *session) recordFailure(reason string) {
+	s.server.bans.recordFailure(s.clientIP, reason, time.Now())
+}
+
+// requestDisconnect asks the session to send a CallDisconnect; it ends when the client acknowledges it
+func (s *session) requestDisconnect(reason string) {
+	s.disconnectOnce.Do(func() {
+		s.disconnectReason = reason
+		close(s.disconnect)
+	})
+}
+
+// end tears down the session after run returns, aborting the call if it failed
+func (s *session) end(err error) {
+	defer func() {
+		s.stopPPPD()
+		// pppd's output has all been unescaped once it has been reaped
+		s.pppd.unescaper.release()
+		s.stopCapture(s.capture.Load(), errSessionEnded)
+	}()
+
+	var abort *abortError
+	switch {
+	case err == nil:
+		s.log().Info("Client disconnected")
+	case errors.Is(err, errDisconnected):
+		s.log().Info("Client acknowledged disconnect", "reason", s.disconnectReason)
+		if s.disconnectReason == disconnectShutdown {
+			atomic.AddInt64(&s.server.disconnectAcks, 1)
+		}
+	case errors.Is(err, errClientAborted):
+		s.log().Warn("Session aborted by client", "err", err)
+	case errors.As(err, &abort):
+		s.log().Warn("Aborting session", "err", err)
+		if abort.attributeID == AttributeIDCryptoBinding {
+			s.recordFailure(failureCryptoBinding)
+		} else if abort.status == StatusInvalidFrameReceived || abort.status == StatusUnacceptedFrameReceived {
+			s.recordFailure(failureMalformed)
+		}
+		if sendErr := sendCallAbortPacket(s, abort.status, abort.attributeID); sendErr != nil {
+			s.log().Debug("failed to send CallAbort", "err", sendErr)
+		}
+	default:
+		s.log().Warn("Session failed", "err", err)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const sstpPath = "/sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+func startTestServer(t *testing.T, cfg *config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	settings, err := newListenerSettings(cfg.Listeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newServer(cfg).serve(l, settings)
+	return l.Addr().String()
+}
+
+func dialTest(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// dialSSTP connects and completes the HTTP handshake, returning a connection ready for SSTP packets
+func dialSSTP(t *testing.T, addr string) net.Conn {
+	conn := dialTest(t, addr)
+	handshakeSSTP(t, conn)
+	return conn
+}
+
+func handshakeSSTP(t *testing.T, conn net.Conn) {
+	_, err := io.WriteString(conn, "SSTP_DUPLEX_POST "+sstpPath+" HTTP/1.1\r\nHost: test\r\nContent-Length: 18446744073709551615\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readHTTPResponse(t, conn)
+}
+
+// readHTTPResponse reads a 200 response to SSTP_DUPLEX_POST
+func readHTTPResponse(t *testing.T, conn net.Conn) {
+	// Read the response headers a byte at a time, so no SSTP data is buffered
+	var response strings.Builder
+	var b [1]byte
+	for !strings.HasSuffix(response.String(), "\r\n\r\n") {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			t.Fatalf("reading HTTP response: %v", err)
+		}
+		response.WriteByte(b[0])
+	}
+	if !strings.HasPrefix(response.String(), "HTTP/1.1 200 OK") {
+		t.Fatalf("unexpected HTTP response %q", response.String())
+	}
+}
+
+func controlPacket(messageType MessageType, attributes ...sstpAttribute) []byte {
+	length := 8
+	for _, attribute := range attributes {
+		length += int(attribute.Length)
+	}
+	header := sstpControlHeader{sstpHeader{1, 0, true, uint16(length)}, messageType, uint16(len(attributes)), attributes}
+	outputBytes := make([]byte, length)
+	packControlHeader(header, outputBytes)
+	return outputBytes
+}
+
+func connectRequestPacket() []byte {
+	return controlPacket(MessageTypeCallConnectRequest, sstpAttribute{0, AttributeIDEncapsulatedProtocolID, 6, []byte{0, 1}})
+}
+
+func readTestPacket(t testing.TB, conn net.Conn) (bool, []byte) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatalf("reading packet header: %v", err)
+	}
+	isControl, length, err := decodeHeader(header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("reading packet: %v", err)
+	}
+	return isControl, data
+}
+
+func expectControl(t testing.TB, conn net.Conn, messageType MessageType) sstpControlHeader {
+	isControl, data := readTestPacket(t, conn)
+	if !isControl {
+		t.Fatalf("expected %v, got data packet", messageType)
+	}
+	header, err := parseControl(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MessageType != messageType {
+		t.Fatalf("expected %v, got %v", messageType, header.MessageType)
+	}
+	return header
+}
+
+func expectAbortStatus(t *testing.T, conn net.Conn, status StatusCode) {
+	header := expectControl(t, conn, MessageTypeCallAbort)
+	if status == StatusNoError {
+		if len(header.Attributes) != 0 {
+			t.Fatalf("expected no attributes, got %v", header.Attributes)
+		}
+		return
+	}
+	if len(header.Attributes) != 1 || header.Attributes[0].AttributeID != AttributeIDStatusInfo {
+		t.Fatalf("expected StatusInfo attribute, got %v", header.Attributes)
+	}
+	_, gotStatus, err := parseStatusInfo(header.Attributes[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus != status {
+		t.Fatalf("expected status %v, got %v", status, gotStatus)
+	}
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	var b [1]byte
+	if _, err := conn.Read(b[:]); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+// expectServing checks that the listener still accepts and answers new connections
+func expectServing(t *testing.T, addr string) {
+	conn := dialTest(t, addr)
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("listener stopped serving: %v", err)
+	}
+	if !strings.HasPrefix(line, "HTTP/1.1 405") {
+		t.Fatalf("unexpected response %q", line)
+	}
+}
+
+func TestSessionFailuresAreIsolated(t *testing.T) {
+	tests := []struct {
+		name  string
+		drive func(t *testing.T, addr string)
+	}{
+		{"malformed HTTP", func(t *testing.T, addr string) {
+			conn := dialTest(t, addr)
+			io.WriteString(conn, "GARBAGE\r\n")
+			conn.(*net.TCPConn).CloseWrite()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if !strings.HasPrefix(line, "HTTP/1.1 400") {
+				t.Fatalf("unexpected response %q", line)
+			}
+		}},
+		{"disconnect during HTTP", func(t *testing.T, addr string) {
+			conn := dialTest(t, addr)
+			conn.Close()
+		}},
+		{"invalid SSTP header", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			conn.Write([]byte{0x20, 0, 0, 8})
+			expectAbortStatus(t, conn, StatusInvalidFrameReceived)
+			expectClosed(t, conn)
+		}},
+		{"truncated packet", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			conn.Write([]byte{0x10, 0, 0, 100, 1, 2, 3})
+			conn.(*net.TCPConn).CloseWrite()
+			expectClosed(t, conn)
+		}},
+		{"malformed attribute", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			packet := connectRequestPacket()
+			binary.BigEndian.PutUint16(packet[10:12], 200)
+			conn.Write(packet)
+			expectAbortStatus(t, conn, StatusInvalidFrameReceived)
+			expectClosed(t, conn)
+		}},
+		{"no encapsulated protocol", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			conn.Write(controlPacket(MessageTypeCallConnectRequest))
+			expectAbortStatus(t, conn, StatusRequiredAttributeMissing)
+			expectClosed(t, conn)
+		}},
+		{"unsupported protocol retried", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			request := controlPacket(MessageTypeCallConnectRequest, sstpAttribute{0, AttributeIDEncapsulatedProtocolID, 6, []byte{0, 2}})
+			for i := 0; i < maxConnectNaks; i++ {
+				conn.Write(request)
+				expectControl(t, conn, MessageTypeCallConnectNak)
+			}
+			conn.Write(request)
+			expectAbortStatus(t, conn, StatusRetryCountExceeded)
+			expectClosed(t, conn)
+		}},
+		{"data before pppd", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			conn.Write(packDataPacketFast([]byte{0xff, 0x03, 0xc0, 0x21}))
+			expectAbortStatus(t, conn, StatusUnacceptedFrameReceived)
+			expectClosed(t, conn)
+		}},
+		{"client CallAbort", func(t *testing.T, addr string) {
+			conn := dialSSTP(t, addr)
+			conn.Write(controlPacket(MessageTypeCallAbort, packStatusInfo(0, StatusNegotiationTimeout)))
+			expectClosed(t, conn)
+		}},
+		{"pppd fails to start", func(t *testing.T, addr string) {
+			failures := atomic.LoadUint64(&metricPPPDSpawnFailures.value)
+			conn := dialSSTP(t, addr)
+			conn.Write(connectRequestPacket())
+			expectControl(t, conn, MessageTypeCallConnectAck)
+			expectAbortStatus(t, conn, StatusNoError)
+			expectClosed(t, conn)
+			if atomic.LoadUint64(&metricPPPDSpawnFailures.value) != failures+1 {
+				t.Fatal("pppd spawn failure not counted")
+			}
+		}},
+	}
+
+	cfg := defaultConfig()
+	cfg.PPP.Pppd = "/nonexistent/pppd"
+	addr := startTestServer(t, cfg)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.drive(t, addr)
+			expectServing(t, addr)
+		})
+	}
+}
+
+func TestCallConnectNak(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	client := pipeSSTP(t, newServer(cfg))
+	naks := atomic.LoadUint64(&metricHandshakes.With("nak").value)
+
+	// A protocol other than PPP is refused with the one supported
+	client.Write(controlPacket(MessageTypeCallConnectRequest, sstpAttribute{0, AttributeIDEncapsulatedProtocolID, 6, []byte{0, 2}}))
+	nak := expectControl(t, client, MessageTypeCallConnectNak)
+	if len(nak.Attributes) != 1 || nak.Attributes[0].AttributeID != AttributeIDStatusInfo {
+		t.Fatalf("expected a StatusInfo attribute, got %v", nak.Attributes)
+	}
+	attributeID, status, err := parseStatusInfo(nak.Attributes[0].Data)
+	if err != nil || attributeID != AttributeIDEncapsulatedProtocolID || status != StatusValueNotSupported {
+		t.Fatalf("expected the encapsulated protocol to be unsupported, got %v %v %v", attributeID, status, err)
+	}
+	if supported := nak.Attributes[0].Data[8:]; !bytes.Equal(supported, []byte{0, 1}) {
+		t.Errorf("expected PPP as the supported protocol, got %x", supported)
+	}
+	if atomic.LoadUint64(&metricHandshakes.With("nak").value) != naks+1 {
+		t.Error("expected the nak to be counted")
+	}
+
+	// The client may try again
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+}
+
+// The user is added to the session's logger while pppd's goroutines and the admin interface log
+func TestSetUsernameWhileLogging(t *testing.T) {
+	logs := &logBuffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	defer slog.SetDefault(defaultLogger)
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	s := newSession(newServer(defaultConfig()), serverConn)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.log().Info("frame")
+		}
+	}()
+	s.setUsername("alice")
+	<-done
+	s.log().Info("after")
+	if !strings.Contains(logs.String(), "msg=after session="+s.id+" remote=pipe user=alice") {
+		t.Fatalf("expected the user in the session's log:\n%s", logs)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shapingLimits are bandwidth limits and byte quotas for a session. Zero values are unlimited.
+type shapingLimits struct {
+	// UpstreamKbps limits data from the client, DownstreamKbps data to the client, in kilobits per second
+	UpstreamKbps   int `toml:"upstream_kbps" json:"upstream_kbps"`
+	DownstreamKbps int `toml:"downstream_kbps" json:"downstream_kbps"`
+	// SessionQuotaMB caps the megabytes a session may transfer in both directions
+	SessionQuotaMB int `toml:"session_quota_mb" json:"session_quota_mb"`
+	// PeriodQuotaMB caps the megabytes a user may transfer across sessions in each shaping period
+	PeriodQuotaMB int `toml:"period_quota_mb" json:"period_quota_mb"`
+}
+
+// shapingRule applies limits to a user, or to a group of users
+type shapingRule struct {
+	Name  string   `toml:"name"`
+	Users []string `toml:"users"` // members, for groups
+	shapingLimits
+}
+
+// limitsFor returns the limits for a user: their own rule if they have one, otherwise their
+// group's, otherwise the defaults
+func (cfg shapingConfig) limitsFor(username string) shapingLimits {
+	for _, user := range cfg.Users {
+		if user.Name == username {
+			return user.shapingLimits
+		}
+	}
+	for _, group := range cfg.Groups {
+		if slices.Contains(group.Users, username) {
+			return group.shapingLimits
+		}
+	}
+	return cfg.shapingLimits
+}
+
+// Burst allowance of a shaped direction, as a fraction of a second's traffic
+const shapingBurstSeconds = 0.25
+
+// Smallest burst allowance, so a full-size frame doesn't always have to wait
+const minShapingBurst = 4096
+
+// byteShaper delays data to keep a direction of a session under its rate
+type byteShaper struct {
+	bucket tokenBucket
+	rate   float64 // bytes per second, 0 is unlimited
+	burst  float64
+}
+
+func (b *byteShaper) setRate(kbps int, now time.Time) {
+	b.rate = float64(kbps) * 1000 / 8
+	b.burst = max(b.rate*shapingBurstSeconds, minShapingBurst)
+	b.bucket = tokenBucket{tokens: b.burst, last: now}
+}
+
+// take uses n bytes of allowance, returning how long to wait before sending them.
+// Frames larger than the remaining allowance go into debt rather than waiting forever.
+func (b *byteShaper) take(n int, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.bucket.refill(b.rate, b.burst, now)
+	b.bucket.tokens -= float64(n)
+	if b.bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.bucket.tokens / b.rate * float64(time.Second))
+}
+
+// periodUsage counts a user's bytes in the current shaping period, across sessions
+type periodUsage struct {
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+}
+
+// add counts n bytes, starting a new period if the current one is over, and returns the period's total
+func (u *periodUsage) add(n int, period time.Duration, now time.Time) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.start.IsZero() || now.Sub(u.start) >= period {
+		u.start = now
+		u.bytes = 0
+	}
+	u.bytes += int64(n)
+	return u.bytes
+}
+
+// userUsage returns the period usage shared by every session of a user
+func (srv *server) userUsage(username string) *periodUsage {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	usage, ok := srv.usage[username]
+	if !ok {
+		usage = &periodUsage{}
+		srv.usage[username] = usage
+	}
+	return usage
+}
+
+// sessionShaping is a session's bandwidth and quota state. Its mutex also guards the
+// session's username, for the admin interface.
+type sessionShaping struct {
+	mu     sync.Mutex
+	limits shapingLimits
+	// overridden is set when limits were given through the admin interface, e.g. from RADIUS,
+	// so they aren't replaced when the username becomes known
+	overridden bool
+	upstream   byteShaper
+	downstream byteShaper
+	bytes      int64
+	period     *periodUsage
+	// exceeded is set, under mu, once a quota is exceeded; data is dropped from then on
+	exceeded atomic.Bool
+}
+
+// setLimits applies limits to the session, resetting its rate allowances
+func (s *session) setLimits(limits shapingLimits, overridden bool) {
+	s.shaping.mu.Lock()
+	defer s.shaping.mu.Unlock()
+	if s.shaping.overridden && !overridden {
+		return
+	}
+	now := time.Now()
+	s.shaping.limits = limits
+	s.shaping.overridden = overridden
+	s.shaping.upstream.setRate(limits.UpstreamKbps, now)
+	s.shaping.downstream.setRate(limits.DownstreamKbps, now)
+	if limits != (shapingLimits{}) {
+		s.log().Info("Session limits applied", "upstream_kbps", limits.UpstreamKbps, "downstream_kbps", limits.DownstreamKbps,
+			"session_quota_mb", limits.SessionQuotaMB, "period_quota_mb", limits.PeriodQuotaMB)
+	}
+}
+
+// shapeData counts n bytes of data in one direction against the session's quotas, then waits
+// until its rate limit allows them to be sent. It returns false if the session ended while waiting.
+func (s *session) shapeData(n int, upstream bool) bool {
+	now := time.Now()
+	s.shaping.mu.Lock()
+	s.shaping.bytes += int64(n)
+	var periodBytes int64
+	if s.shaping.period != nil {
+		periodBytes = s.shaping.period.add(n, s.server.config.Shaping.Period, now)
+	}
+	limits := s.shaping.limits
+	sessionBytes := s.shaping.bytes
+	exceeded := !s.shaping.exceeded.Load() &&
+		(limits.SessionQuotaMB > 0 && sessionBytes > int64(limits.SessionQuotaMB)<<20 ||
+			limits.PeriodQuotaMB > 0 && periodBytes > int64(limits.PeriodQuotaMB)<<20)
+	if exceeded {
+		s.shaping.exceeded.Store(true)
+	}
+	var delay time.Duration
+	if upstream {
+		delay = s.shaping.upstream.take(n, now)
+	} else {
+		delay = s.shaping.downstream.take(n, now)
+	}
+	s.shaping.mu.Unlock()
+
+	if exceeded {
+		metricQuotaDisconnects.Inc()
+		s.log().Warn("Quota exceeded, disconnecting", "session_bytes", sessionBytes, "period_bytes", periodBytes)
+		s.requestDisconnect(disconnectQuota)
+	}
+	if delay == 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// startUserShaping applies the configured limits for the authenticating user and starts
+// counting their usage for the period quota
+func (s *session) startUserShaping(username string) {
+	usage := s.server.userUsage(username)
+	s.shaping.mu.Lock()
+	s.shaping.period = usage
+	s.shaping.mu.Unlock()
+	s.setLimits(s.server.config.Shaping.limitsFor(username), false)
+	// A user already over their period quota is disconnected straight away
+	s.shapeData(0, true)
+}
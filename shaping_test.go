@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShapingConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sstp-go.toml")
+	os.WriteFile(path, []byte(`
+[shaping]
+downstream_kbps = 2000
+period = "24h"
+[[shaping.group]]
+name = "staff"
+users = ["alice", "bob"]
+downstream_kbps = 50000
+period_quota_mb = 10000
+[[shaping.user]]
+name = "bob"
+upstream_kbps = 100
+`), 0644)
+	cfg, _, err := parseCommandLine([]string{"-config", path}, func(string) string { return "" }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]shapingLimits{
+		"alice":   {DownstreamKbps: 50000, PeriodQuotaMB: 10000},
+		"bob":     {UpstreamKbps: 100},
+		"mallory": {DownstreamKbps: 2000},
+	}
+	for user, expected := range tests {
+		if limits := cfg.Shaping.limitsFor(user); limits != expected {
+			t.Errorf("%s: expected %+v, got %+v", user, expected, limits)
+		}
+	}
+	if cfg.Shaping.Period != 24*time.Hour {
+		t.Errorf("period not applied: %v", cfg.Shaping.Period)
+	}
+}
+
+func TestByteShaper(t *testing.T) {
+	var shaper byteShaper
+	now := time.Now()
+	shaper.setRate(0, now)
+	if delay := shaper.take(1<<20, now); delay != 0 {
+		t.Fatalf("unlimited shaper delayed %v", delay)
+	}
+
+	// 800 kbit/s is 100000 bytes per second, with a quarter second of burst
+	shaper.setRate(800, now)
+	if delay := shaper.take(25000, now); delay != 0 {
+		t.Fatalf("burst delayed %v", delay)
+	}
+	if delay := shaper.take(10000, now); delay != 100*time.Millisecond {
+		t.Fatalf("expected 100ms delay, got %v", delay)
+	}
+	// The debt is repaid before more is allowed
+	if delay := shaper.take(10000, now.Add(100*time.Millisecond)); delay != 100*time.Millisecond {
+		t.Fatalf("expected 100ms delay after repaying, got %v", delay)
+	}
+}
+
+func TestSessionQuota(t *testing.T) {
+	cfg, _ := fakePPPD(t, idlePPPD)
+	cfg.Shaping.SessionQuotaMB = 1
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	go func() {
+		data := make([]byte, 4000)
+		for i := 0; i < 300; i++ {
+			if _, err := client.Write(packDataPacketFast(data)); err != nil {
+				return
+			}
+		}
+	}()
+	expectControl(t, client, MessageTypeCallDisconnect)
+	client.Write(controlPacket(MessageTypeCallDisconnectAck))
+	expectClosed(t, client)
+}
+
+func TestAdminSessionLimits(t *testing.T) {
+	srv := newServer(defaultConfig())
+	client := pipeSSTP(t, srv)
+	admin := httptest.NewServer(newAdminHandler(srv))
+	defer admin.Close()
+
+	response, err := http.Get(admin.URL + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []adminSession
+	json.NewDecoder(response.Body).Decode(&sessions)
+	if len(sessions) != 1 {
+		t.Fatalf("expected one session, got %+v", sessions)
+	}
+
+	request, _ := http.NewRequest(http.MethodPut, admin.URL+"/sessions/"+sessions[0].ID+"/limits?upstream_kbps=512&session_quota_mb=100", nil)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updated adminSession
+	json.NewDecoder(response.Body).Decode(&updated)
+	if updated.Limits != (shapingLimits{UpstreamKbps: 512, SessionQuotaMB: 100}) {
+		t.Fatalf("limits not applied: %+v", updated)
+	}
+
+	request, _ = http.NewRequest(http.MethodDelete, admin.URL+"/sessions/"+sessions[0].ID, nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusAccepted {
+		t.Fatalf("disconnect failed: %v %v", response, err)
+	}
+	expectControl(t, client, MessageTypeCallDisconnect)
+}
+
+// A client which ignores CallDisconnect after going over its quota gets nothing more through, and
+// is aborted once the acknowledgement is overdue
+func TestQuotaDisconnectIgnored(t *testing.T) {
+	cfg, pppd := fakePPPD(t, "exec cat > \"$0.received\"\n")
+	cfg.Shaping.SessionQuotaMB = 1
+	cfg.Timeouts.DisconnectAck = 100 * time.Millisecond
+	srv := newServer(cfg)
+	client := pipeSSTP(t, srv)
+
+	client.Write(connectRequestPacket())
+	expectControl(t, client, MessageTypeCallConnectAck)
+	go func() {
+		// Bytes which aren't escaped, nor a valid PPP header for the MRU to apply to
+		data := bytes.Repeat([]byte{0x40}, 4000)
+		for i := 0; i < 500; i++ {
+			if _, err := client.Write(packDataPacketFast(data)); err != nil {
+				return
+			}
+		}
+	}()
+	expectControl(t, client, MessageTypeCallDisconnect)
+	expectAbortStatus(t, client, StatusNoError)
+	expectClosed(t, client)
+
+	info, err := os.Stat(pppd + ".received")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The frame which went over the quota still gets through, with its framing
+	if info.Size() > 1<<20+2*4010 {
+		t.Errorf("pppd received %d bytes after a 1MB quota", info.Size())
+	}
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// N_HDLC line discipline, which keeps each write to a tty and each read from it a whole frame
+const lineDisciplineHDLC = 13
+
+// openSyncPTY opens a pseudo-terminal for pppd's sync mode. It returns the master, which reads
+// and writes one PPP frame at a time, and the path of the slave for pppd to use as its device.
+func openSyncPTY() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var number uint32
+	unlock := int32(0)
+	discipline := int32(lineDisciplineHDLC)
+	err = ioctl(master, syscall.TIOCSETD, unsafe.Pointer(&discipline))
+	if err != nil {
+		err = fmt.Errorf("setting N_HDLC line discipline: %w", err)
+	} else if err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number))
+	}
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", number), nil
+}
+
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openSyncPTY() (*os.File, string, error) {
+	return nil, "", errors.New("sync framing needs Linux's N_HDLC line discipline")
+}
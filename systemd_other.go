@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func inheritSystemdSockets() ([]*systemdSocket, error) {
+	return nil, errors.New("socket activation needs a Unix system")
+}
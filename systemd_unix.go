@@ -0,0 +1,51 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor passed by systemd
+const systemdFirstFD = 3
+
+// inheritSystemdSockets takes the sockets passed through LISTEN_FDS. The variables are removed
+// so child processes such as pppd don't mistake the sockets for their own.
+func inheritSystemdSockets() ([]*systemdSocket, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_PID is not this process)")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS=%q)", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var sockets []*systemdSocket
+	for i := 0; i < count; i++ {
+		fd := systemdFirstFD + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), "systemd:"+name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%q) passed by systemd: %v", fd, name, err)
+		}
+		sockets = append(sockets, &systemdSocket{name: name, listener: listener})
+	}
+	return sockets, nil
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/* A small subset of TOML v1.0.0, enough for the configuration file
+ * https://toml.io/en/v1.0.0
+ *
+ * Supported: comments, [tables], [[arrays of tables]], dotted bare keys,
+ * basic and literal strings, integers, floats, booleans and arrays (which may span lines).
+ * Not supported: inline tables, multi-line strings and date/time values.
+ */
+
+type tomlParser struct {
+	name  string
+	root  map[string]interface{}
+	table map[string]interface{}
+	// Explicitly defined tables, so they can't be defined twice
+	defined map[string]bool
+}
+
+func parseTOML(name string, input string) (map[string]interface{}, error) {
+	p := &tomlParser{name: name, root: make(map[string]interface{}), defined: make(map[string]bool)}
+	p.table = p.root
+
+	lines := strings.Split(strings.ReplaceAll(input, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		line, err := stripComment(lines[i])
+		if err != nil {
+			return nil, p.errorf(lineNumber, "%v", err)
+		}
+		// Join lines of multi-line arrays
+		for arrayDepth(line) > 0 && i+1 < len(lines) {
+			i++
+			next, err := stripComment(lines[i])
+			if err != nil {
+				return nil, p.errorf(i+1, "%v", err)
+			}
+			line += " " + next
+		}
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+		if err := p.parseLine(line); err != nil {
+			return nil, p.errorf(lineNumber, "%v", err)
+		}
+	}
+	return p.root, nil
+}
+
+func (p *tomlParser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.name, line, fmt.Sprintf(format, args...))
+}
+
+// stripComment removes a trailing # comment which isn't inside a string
+func stripComment(line string) (string, error) {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#':
+			return line[:i], nil
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		}
+	}
+	if quote != 0 {
+		return "", fmt.Errorf("unterminated string")
+	}
+	return line, nil
+}
+
+// arrayDepth returns the number of unclosed [ brackets outside strings in a value
+func arrayDepth(line string) int {
+	equals := strings.IndexByte(line, '=')
+	if equals < 0 {
+		return 0
+	}
+	depth := 0
+	var quote byte
+	for i := equals + 1; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == '[':
+			depth++
+		case quote == 0 && c == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+func (p *tomlParser) parseLine(line string) error {
+	if strings.HasPrefix(line, "[[") {
+		if !strings.HasSuffix(line, "]]") {
+			return fmt.Errorf("malformed array of tables header %q", line)
+		}
+		return p.startArrayTable(strings.TrimSpace(line[2 : len(line)-2]))
+	}
+	if strings.HasPrefix(line, "[") {
+		if !strings.HasSuffix(line, "]") {
+			return fmt.Errorf("malformed table header %q", line)
+		}
+		return p.startTable(strings.TrimSpace(line[1 : len(line)-1]))
+	}
+
+	equals := strings.IndexByte(line, '=')
+	if equals < 0 {
+		return fmt.Errorf("expected key = value, got %q", line)
+	}
+	keys, err := parseKey(strings.TrimSpace(line[:equals]))
+	if err != nil {
+		return err
+	}
+	value, rest, err := parseValue(strings.TrimSpace(line[equals+1:]))
+	if err != nil {
+		return fmt.Errorf("key %q: %v", strings.Join(keys, "."), err)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return fmt.Errorf("key %q: unexpected %q after value", strings.Join(keys, "."), rest)
+	}
+
+	table, err := descend(p.table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := table[last]; exists {
+		return fmt.Errorf("duplicate key %q", strings.Join(keys, "."))
+	}
+	table[last] = value
+	return nil
+}
+
+func parseKey(key string) ([]string, error) {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if len(part) >= 2 && part[0] == '"' && part[len(part)-1] == '"' {
+			unquoted, err := strconv.Unquote(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted key %s", part)
+			}
+			part = unquoted
+		} else if part == "" || strings.IndexFunc(part, func(r rune) bool {
+			return !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}) >= 0 {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		parts[i] = part
+	}
+	return parts, nil
+}
+
+// descend walks dotted keys from table, creating intermediate tables
+func descend(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		switch next := table[key].(type) {
+		case nil:
+			child := make(map[string]interface{})
+			table[key] = child
+			table = child
+		case map[string]interface{}:
+			table = next
+		case []map[string]interface{}:
+			// Keys under an array of tables refer to its last element
+			table = next[len(next)-1]
+		default:
+			return nil, fmt.Errorf("key %q is already defined as a value", key)
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) startTable(header string) error {
+	keys, err := parseKey(header)
+	if err != nil {
+		return err
+	}
+	if p.defined[header] {
+		return fmt.Errorf("table [%s] defined more than once", header)
+	}
+	p.defined[header] = true
+	p.table, err = descend(p.root, keys)
+	return err
+}
+
+func (p *tomlParser) startArrayTable(header string) error {
+	keys, err := parseKey(header)
+	if err != nil {
+		return err
+	}
+	parent, err := descend(p.root, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	table := make(map[string]interface{})
+	switch existing := parent[last].(type) {
+	case nil:
+		parent[last] = []map[string]interface{}{table}
+	case []map[string]interface{}:
+		parent[last] = append(existing, table)
+	default:
+		return fmt.Errorf("key %q is already defined and is not an array of tables", header)
+	}
+	// Subtables of the previous element may be defined again for the new one
+	for defined := range p.defined {
+		if strings.HasPrefix(defined, header+".") {
+			delete(p.defined, defined)
+		}
+	}
+	p.table = table
+	return nil
+}
+
+// parseValue parses one value from the start of input, returning the remaining input
+func parseValue(input string) (interface{}, string, error) {
+	if input == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	switch input[0] {
+	case '"':
+		end := 1
+		for end < len(input) && input[end] != '"' {
+			if input[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(input) {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		value, err := unescapeString(input[1:end])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid string %s: %w", input[:end+1], err)
+		}
+		return value, input[end+1:], nil
+	case '\'':
+		end := strings.IndexByte(input[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return input[1 : end+1], input[end+2:], nil
+	case '[':
+		values := make([]interface{}, 0)
+		rest := strings.TrimSpace(input[1:])
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return values, rest[1:], nil
+			}
+			value, next, err := parseValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, value)
+			rest = strings.TrimSpace(next)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	case '{':
+		return nil, "", fmt.Errorf("inline tables are not supported")
+	}
+
+	end := strings.IndexAny(input, ",] \t")
+	if end < 0 {
+		end = len(input)
+	}
+	token, rest := input[:end], input[end:]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	value, err := parseNumber(token)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, rest, nil
+}
+
+// TOML numbers: underscores only between digits, no leading zeros, and only lower case prefixes
+// on unsigned integers in other bases
+var (
+	tomlDecimal = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+	tomlFloat   = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)((\.[0-9](_?[0-9])*)([eE][+-]?[0-9](_?[0-9])*)?|[eE][+-]?[0-9](_?[0-9])*)$|^[+-]?(inf|nan)$`)
+	tomlBases   = []struct {
+		prefix string
+		base   int
+		digits *regexp.Regexp
+	}{
+		{"0x", 16, regexp.MustCompile(`^[0-9a-fA-F](_?[0-9a-fA-F])*$`)},
+		{"0o", 8, regexp.MustCompile(`^[0-7](_?[0-7])*$`)},
+		{"0b", 2, regexp.MustCompile(`^[01](_?[01])*$`)},
+	}
+)
+
+func parseNumber(token string) (interface{}, error) {
+	cleaned := strings.ReplaceAll(token, "_", "")
+	for _, b := range tomlBases {
+		if digits, ok := strings.CutPrefix(token, b.prefix); ok && b.digits.MatchString(digits) {
+			if integer, err := strconv.ParseInt(cleaned[2:], b.base, 64); err == nil {
+				return integer, nil
+			}
+			return nil, fmt.Errorf("integer %s out of range", token)
+		}
+	}
+	if tomlDecimal.MatchString(token) {
+		if integer, err := strconv.ParseInt(cleaned, 10, 64); err == nil {
+			return integer, nil
+		}
+		return nil, fmt.Errorf("integer %s out of range", token)
+	}
+	if tomlFloat.MatchString(token) {
+		if float, err := strconv.ParseFloat(cleaned, 64); err == nil {
+			return float, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q", token)
+}
+
+// unescapeString decodes the body of a basic string, which allows only TOML's escapes rather than
+// Go's
+func unescapeString(body string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			if c < 0x20 && c != '\t' || c == 0x7f {
+				return "", fmt.Errorf("control character %#x", c)
+			}
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(body) {
+			return "", fmt.Errorf("unterminated escape")
+		}
+		switch body[i] {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case '"':
+			b.WriteByte('"')
+		case '\\':
+			b.WriteByte('\\')
+		case 'u', 'U':
+			length := 4
+			if body[i] == 'U' {
+				length = 8
+			}
+			code, err := strconv.ParseUint(body[i+1:min(i+1+length, len(body))], 16, 32)
+			if err != nil || i+1+length > len(body) || !utf8.ValidRune(rune(code)) {
+				return "", fmt.Errorf("invalid escape \\%s", body[i:min(i+1+length, len(body))])
+			}
+			b.WriteRune(rune(code))
+			i += length
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", body[i])
+		}
+	}
+	return b.String(), nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeTOML stores parsed TOML into the struct pointed to by output, using `toml` field tags.
+// Strings are accepted for any scalar field, so values from flags and the environment can be merged in.
+func decodeTOML(input map[string]interface{}, output interface{}) error {
+	return decodeTable(input, reflect.ValueOf(output).Elem(), "")
+}
+
+func decodeTable(input map[string]interface{}, output reflect.Value, path string) error {
+	fields := make(map[string]reflect.Value)
+	tableFields(output, fields)
+
+	for key, value := range input {
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q", path+key)
+		}
+		if err := decodeValue(value, field, path+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableFields maps the toml tags of a struct to its fields. Untagged embedded structs share their fields.
+func tableFields(output reflect.Value, fields map[string]reflect.Value) {
+	outputType := output.Type()
+	for i := 0; i < outputType.NumField(); i++ {
+		field := outputType.Field(i)
+		tag := field.Tag.Get("toml")
+		if tag != "" {
+			fields[tag] = output.Field(i)
+		} else if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			tableFields(output.Field(i), fields)
+		}
+	}
+}
+
+func decodeValue(input interface{}, output reflect.Value, path string) error {
+	if output.Type() == durationType {
+		s, ok := input.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a duration string such as \"30s\", got %v", path, input)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		output.SetInt(int64(d))
+		return nil
+	}
+
+	switch output.Kind() {
+	case reflect.String:
+		s, ok := input.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %v", path, input)
+		}
+		output.SetString(s)
+	case reflect.Bool:
+		switch v := input.(type) {
+		case bool:
+			output.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: expected true or false, got %q", path, v)
+			}
+			output.SetBool(b)
+		default:
+			return fmt.Errorf("%s: expected true or false, got %v", path, input)
+		}
+	case reflect.Int, reflect.Int64, reflect.Uint16, reflect.Uint32:
+		var n int64
+		switch v := input.(type) {
+		case int64:
+			n = v
+		case string:
+			var err error
+			n, err = strconv.ParseInt(v, 0, 64)
+			if err != nil {
+				return fmt.Errorf("%s: expected an integer, got %q", path, v)
+			}
+		default:
+			return fmt.Errorf("%s: expected an integer, got %v", path, input)
+		}
+		if output.Kind() == reflect.Uint16 || output.Kind() == reflect.Uint32 {
+			if n < 0 || output.OverflowUint(uint64(n)) {
+				return fmt.Errorf("%s: %d is out of range", path, n)
+			}
+			output.SetUint(uint64(n))
+		} else {
+			output.SetInt(n)
+		}
+	case reflect.Slice:
+		if table, ok := input.(map[string]interface{}); ok {
+			// A single [table] is accepted where an array of tables is expected
+			input = []map[string]interface{}{table}
+		}
+		if tables, ok := input.([]map[string]interface{}); ok && output.Type().Elem().Kind() == reflect.Struct {
+			slice := reflect.MakeSlice(output.Type(), len(tables), len(tables))
+			for i, table := range tables {
+				// Start from the existing default for the first element, if there is one
+				if i < output.Len() {
+					slice.Index(i).Set(output.Index(i))
+				}
+				if err := decodeTable(table, slice.Index(i), fmt.Sprintf("%s[%d].", path, i)); err != nil {
+					return err
+				}
+			}
+			output.Set(slice)
+			return nil
+		}
+		var values []interface{}
+		switch v := input.(type) {
+		case []interface{}:
+			values = v
+		case string:
+			// Comma separated list from a flag or environment variable
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					values = append(values, s)
+				}
+			}
+		default:
+			return fmt.Errorf("%s: expected an array, got %v", path, input)
+		}
+		slice := reflect.MakeSlice(output.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := decodeValue(value, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		output.Set(slice)
+	case reflect.Struct:
+		table, ok := input.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a table, got %v", path, input)
+		}
+		return decodeTable(table, output, path+".")
+	default:
+		return fmt.Errorf("%s: unsupported field type %v", path, output.Type())
+	}
+	return nil
+}
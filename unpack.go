@@ -3,20 +3,18 @@ package main
 import (
 	"encoding/binary"
 	"errors"
-	"log"
-	"net"
+	"fmt"
 )
 
 func decodeHeader(input []byte) (bool, int, error) {
 	if len(input) < 4 {
-		log.Print()
 		return true, 0, errors.New("Packet not long enough")
 	}
 
 	majVer := input[0] >> 4
 	minVer := input[0] & 0xf
 	isControl := input[1] == 1
-	length := int(binary.BigEndian.Uint16(input[2:4]))
+	length := int(binary.BigEndian.Uint16(input[2:4]) & 0x0fff) // the top 4 bits are reserved
 
 	if majVer == 1 && minVer == 0 && length > 4 {
 		return isControl, (length - 4), nil
@@ -26,62 +24,158 @@ func decodeHeader(input []byte) (bool, int, error) {
 	return true, 0, errors.New("Invalid packet")
 }
 
-func parseControl(input []byte) sstpControlHeader {
+func parseControl(input []byte) (sstpControlHeader, error) {
 	controlHeader := sstpControlHeader{}
+	if len(input) < 4 {
+		return controlHeader, errors.New("Control packet not long enough")
+	}
 	controlHeader.MessageType = MessageType(binary.BigEndian.Uint16(input[:2]))
 	controlHeader.AttributesLength = binary.BigEndian.Uint16(input[2:4])
 
 	attributes := make([]sstpAttribute, int(controlHeader.AttributesLength))
 	consumedBytes := 4
 	for i := 0; i < len(attributes); i++ {
+		if consumedBytes+4 > len(input) {
+			return controlHeader, errors.New("Attribute header truncated")
+		}
 		attribute := sstpAttribute{}
 		// ignore Reserved byte
 		attribute.AttributeID = AttributeID(input[consumedBytes+1])
 		attribute.Length = binary.BigEndian.Uint16(input[(consumedBytes + 2):(consumedBytes + 4)])
+		if attribute.Length < 4 || consumedBytes+int(attribute.Length) > len(input) {
+			return controlHeader, fmt.Errorf("Invalid length %d for attribute %v", attribute.Length, attribute.AttributeID)
+		}
 		attribute.Data = input[(consumedBytes + 4):(consumedBytes + int(attribute.Length))]
 		consumedBytes += int(attribute.Length)
 
 		attributes[i] = attribute
 	}
 	controlHeader.Attributes = attributes
-	return controlHeader
+	return controlHeader, nil
+}
+
+// parseStatusInfo decodes the data of a StatusInfo attribute
+func parseStatusInfo(data []byte) (AttributeID, StatusCode, error) {
+	if len(data) < 8 {
+		return 0, 0, errors.New("StatusInfo attribute not long enough")
+	}
+	// ignore 3 Reserved bytes
+	return AttributeID(data[3]), StatusCode(binary.BigEndian.Uint32(data[4:8])), nil
 }
 
-func handleDataPacket(data []byte, conn net.Conn, pppdInstance *pppdInstance) {
-	//log.Printf("read: %v\n", dataHeader)
-	if pppdInstance.commandInst == nil {
-		log.Fatal("pppd instance not started")
-	} else {
-		_, err := pppdInstance.stdin.Write(pppEscape(data))
-		handleErr(err)
-		//log.Printf("%v bytes written to pppd", n)
+// parseEncapsulatedProtocol returns the protocol a CallConnectRequest asks for
+func parseEncapsulatedProtocol(attributes []sstpAttribute) (uint16, error) {
+	for _, attribute := range attributes {
+		if attribute.AttributeID != AttributeIDEncapsulatedProtocolID {
+			continue
+		}
+		if len(attribute.Data) != 2 {
+			return 0, &abortError{StatusInvalidAttribValueLength, AttributeIDEncapsulatedProtocolID, errors.New("Encapsulated Protocol ID attribute not 2 bytes")}
+		}
+		return binary.BigEndian.Uint16(attribute.Data), nil
+	}
+	return 0, &abortError{StatusRequiredAttributeMissing, AttributeIDEncapsulatedProtocolID, errors.New("CallConnectRequest without Encapsulated Protocol ID")}
+}
+
+// handleDataPacket queues a frame from the client for pppd, taking ownership of it
+func handleDataPacket(frame pooledFrame, s *session) error {
+	metricDataPackets.With("rx").Inc()
+	metricDataBytes.With("rx").Add(len(frame.data))
+	if s.username == "" {
+		if username, ok := snoopUsername(frame.data); ok {
+			s.setUsername(username)
+		}
 	}
+	if s.oversize("rx", frame.data) {
+		frame.release()
+		return nil
+	}
+	if s.pppd.commandInst == nil {
+		frame.release()
+		return &abortError{StatusUnacceptedFrameReceived, 0, errors.New("data packet received before pppd started")}
+	}
+	s.upstream.push(s, frame)
+	return nil
 }
 
-func handleControlPacket(controlHeader sstpControlHeader, conn net.Conn, pppdInstance *pppdInstance) {
-	log.Printf("read: %v\n", controlHeader)
+func handleControlPacket(controlHeader sstpControlHeader, s *session) error {
+	s.log().Debug("read control packet", "type", controlHeader.MessageType, "attributes", len(controlHeader.Attributes))
+	metricControlMessages.With(controlHeader.MessageType.metricLabel(), "rx").Inc()
 
 	if controlHeader.MessageType == MessageTypeCallConnectRequest {
-		sendConnectionAckPacket(conn)
-		// TODO: implement Nak?
-		// -> if protocols specified by req not supported
-		// however there is only PPP currently, so not a problem
-		createPPPD(pppdInstance, conn)
-		log.Print("pppd instance created")
+		if s.pppd.commandInst != nil {
+			return &abortError{StatusUnacceptedFrameReceived, 0, errors.New("duplicate CallConnectRequest")}
+		}
+		protocol, err := parseEncapsulatedProtocol(controlHeader.Attributes)
+		if err != nil {
+			return err
+		}
+		if protocol != encapsulatedProtocolPPP {
+			s.connectNaks++
+			if s.connectNaks > maxConnectNaks {
+				return &abortError{StatusRetryCountExceeded, 0, fmt.Errorf("encapsulated protocol %d not supported", protocol)}
+			}
+			metricHandshakes.With("nak").Inc()
+			s.log().Warn("Refused CallConnectRequest", "protocol", protocol)
+			return sendConnectNakPacket(s, AttributeIDEncapsulatedProtocolID, StatusValueNotSupported, []byte{0, encapsulatedProtocolPPP})
+		}
+		err = sendConnectionAckPacket(s)
+		if err != nil {
+			return err
+		}
+		metricHandshakes.With("ack").Inc()
+		err = createPPPD(s)
+		if err != nil {
+			return &abortError{StatusNoError, 0, err}
+		}
+		s.log().Info("pppd instance created")
+	} else if controlHeader.MessageType == MessageTypeCallConnected {
+		if s.pppd.commandInst == nil || s.connected {
+			return &abortError{StatusUnacceptedFrameReceived, 0, errors.New("unexpected CallConnected")}
+		}
+		var cryptoBinding *sstpAttribute
+		for i, attribute := range controlHeader.Attributes {
+			if attribute.AttributeID == AttributeIDCryptoBinding {
+				cryptoBinding = &controlHeader.Attributes[i]
+			}
+		}
+		if cryptoBinding == nil {
+			return &abortError{StatusRequiredAttributeMissing, AttributeIDCryptoBinding, errors.New("CallConnected without Crypto Binding")}
+		}
+		err := s.verifyCryptoBinding(cryptoBinding.Data)
+		if err != nil {
+			return err
+		}
+		s.connected = true
+		if s.releasePreAuth != nil {
+			s.releasePreAuth()
+		}
+		s.log().Info("Call connected")
 	} else if controlHeader.MessageType == MessageTypeCallDisconnect {
-		sendDisconnectAckPacket(conn)
-		if pppdInstance.commandInst != nil {
-			// kill pppd if disconnect
-			err := pppdInstance.commandInst.Process.Kill()
-			handleErr(err)
-			pppdInstance.commandInst = nil
+		err := sendDisconnectAckPacket(s)
+		s.stopPPPD()
+		return err
+	} else if controlHeader.MessageType == MessageTypeCallDisconnectAck {
+		select {
+		case <-s.disconnect:
+			return errDisconnected
+		default:
+			return &abortError{StatusUnacceptedFrameReceived, 0, errors.New("unexpected CallDisconnectAck")}
 		}
 	} else if controlHeader.MessageType == MessageTypeEchoRequest {
 		// TODO: implement hello timer and echo request?
-		sendEchoResponsePacket(conn)
+		return sendEchoResponsePacket(s)
 	} else if controlHeader.MessageType == MessageTypeCallAbort {
-		// TODO: parse error
-		log.Fatal("error encountered, connection aborted")
+		metricHandshakes.With("abort").Inc()
+		for _, attribute := range controlHeader.Attributes {
+			if attribute.AttributeID == AttributeIDStatusInfo {
+				attributeID, status, err := parseStatusInfo(attribute.Data)
+				if err == nil {
+					return fmt.Errorf("%w: %v (attribute %v)", errClientAborted, status, attributeID)
+				}
+			}
+		}
+		return errClientAborted
 	}
-	// TODO: implement connected
+	return nil
 }